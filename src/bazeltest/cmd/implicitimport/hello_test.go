@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestLoggers(t *testing.T) {
+	// A busybox initializes l and l2 only when it runs this command.
+	if l == nil || l2 == nil {
+		t.Fatalf("loggers are not initialized: l = %v, l2 = %v", l, l2)
+	}
+	if l.Prefix() != l2.Prefix() {
+		t.Errorf("l.Prefix() = %q, l2.Prefix() = %q, want the same", l.Prefix(), l2.Prefix())
+	}
+}
@@ -0,0 +1,9 @@
+"""Generated by cmdlist.sh -v BAZELTEST_CMDS //src/bazeltest/cmd/...; DO NOT EDIT."""
+
+BAZELTEST_CMDS = [
+    "//src/bazeltest/cmd/dmesg",
+    "//src/bazeltest/cmd/helloworld",
+    "//src/bazeltest/cmd/implicitimport",
+    "//src/bazeltest/cmd/importsamename",
+    "//src/bazeltest/cmd/stdlibconflict",
+]
@@ -0,0 +1,67 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// bbarchive writes the install tree of a busybox, bbin/bb plus a symlink or
+// #! file per command, as a reproducible tar and/or newc cpio archive.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"log"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/archive"
+	"github.com/u-root/gobusybox/src/pkg/uflag"
+)
+
+var (
+	busybox  = flag.String("busybox", "", "Busybox binary")
+	links    = flag.String("links", string(archive.Symlink), "How to link commands to bb: symlink or script (#! files)")
+	tarOut   = flag.String("tar", "", "Tar archive to write")
+	cpioOut  = flag.String("cpio", "", "newc cpio archive to write")
+	commands uflag.Strings
+)
+
+func init() {
+	flag.Var(&commands, "command", "Command name to link to bb")
+}
+
+func main() {
+	flag.Parse()
+
+	if len(*busybox) == 0 {
+		log.Fatal("bbarchive: no busybox given")
+	} else if len(*tarOut) == 0 && len(*cpioOut) == 0 {
+		log.Fatal("bbarchive: no -tar or -cpio output given")
+	}
+
+	bb, err := ioutil.ReadFile(*busybox)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := archive.Entries(bb, commands, archive.LinkType(*links))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *tarOut != "" {
+		var b bytes.Buffer
+		if err := archive.WriteTar(&b, entries); err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(*tarOut, b.Bytes(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *cpioOut != "" {
+		var b bytes.Buffer
+		if err := archive.WriteCPIO(&b, entries); err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(*cpioOut, b.Bytes(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"io/ioutil"
@@ -14,22 +15,91 @@ import (
 	"path/filepath"
 
 	"github.com/u-root/gobusybox/src/pkg/bb"
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
 	"github.com/u-root/gobusybox/src/pkg/golang"
+	"github.com/u-root/gobusybox/src/pkg/uflag"
 )
 
 var (
 	outputPath = flag.String("o", "bb", "Path to compiled busybox binary")
 	genDir     = flag.String("gen-dir", "", "Directory to generate source in")
 	genOnly    = flag.Bool("g", false, "Generate but do not build binaries")
+	lineDirs   = flag.Bool("line-directives", false, "Add //line directives so compiler errors and stack traces refer to original source files (binary will contain absolute source paths)")
+	jsonOut    = flag.Bool("json", false, "Print a JSON build report with structured diagnostics to stdout (logs go to stderr)")
+
+	vet        = flag.Bool("vet", false, "Report patterns in commands that are unsafe to combine into a busybox")
+	vetFatal   = flag.Bool("vet-fatal", false, "Like -vet, but fail the build if any are found")
+	strict     = flag.Bool("strict", false, "Fail if any requested command is skipped instead of building a smaller busybox")
+	auditDeps  = flag.Bool("audit-deps", false, "Report dependencies whose version in the busybox differs from the version the command's own go.mod selects")
+	noUpgrades = flag.Bool("no-upgrades", false, "Like -audit-deps, but fail the build if any command's dependency versions change")
+
+	verifyRepr   = flag.Bool("verify-reproducible", false, "Build the busybox twice in different directories and with shuffled command order, and fail if the binaries differ")
+	hermetic     = flag.Bool("hermetic", false, "Run go commands with only the settings reported by 'go env', not the process environment")
+	hermeticPath = flag.String("hermetic-path", golang.DefaultHermeticPATH, "PATH for go commands with -hermetic, after $GOROOT/bin")
 )
 
+type jsonDiagnostic struct {
+	Kind    string          `json:"kind"`
+	Message string          `json:"message"`
+	Details diag.Diagnostic `json:"details"`
+}
+
+type jsonReport struct {
+	Binary      string           `json:"binary,omitempty"`
+	GenSrcDir   string           `json:"gen_src_dir,omitempty"`
+	GenSrcDirs  []string         `json:"gen_src_dirs,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	Diagnostics []jsonDiagnostic `json:"diagnostics"`
+}
+
+// writeReport prints the JSON build report to stdout.
+func writeReport(binary, genSrcDir string, err error, diags diag.List) {
+	r := jsonReport{
+		GenSrcDir:   genSrcDir,
+		Diagnostics: []jsonDiagnostic{},
+	}
+	if err != nil {
+		r.Error = err.Error()
+		// -verify-reproducible keeps one directory per build.
+		var errBuild *bb.ErrReproducibilityBuild
+		var errRepr *bb.ErrNotReproducible
+		if errors.As(err, &errBuild) {
+			r.GenSrcDirs = errBuild.GenSrcDirs
+		} else if errors.As(err, &errRepr) {
+			r.GenSrcDirs = errRepr.GenSrcDirs[:]
+		}
+	} else {
+		r.Binary = binary
+	}
+	for _, d := range diags {
+		r.Diagnostics = append(r.Diagnostics, jsonDiagnostic{
+			Kind:    d.Kind(),
+			Message: d.Error(),
+			Details: d,
+		})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		log.Fatalf("Could not write JSON report: %v", err)
+	}
+}
+
 func main() {
 	bopts := &golang.BuildOpts{}
 	bopts.RegisterFlags(flag.CommandLine)
+	var excludes, allowExcluded, linkerVars uflag.Strings
+	flag.Var(&excludes, "x", "Directory, Go import path or pattern (e.g. ./cmds/exp/...) of commands to exclude (may be repeated)")
+	flag.Var(&linkerVars, "X", "Set string variable with -ldflags -X as [cmd:]importpath.name=value; main.name refers to the command's main package (may be repeated)")
+	flag.Var(&allowExcluded, "strict-allow-excluded", "Command that -strict allows to be excluded by build constraints for the target platform (may be repeated)")
 	flag.Parse()
 
 	// Why doesn't the log package export this as a default?
 	l := log.New(os.Stdout, "", log.LstdFlags)
+	if *jsonOut {
+		// stdout is reserved for the report.
+		l.SetOutput(os.Stderr)
+	}
 
 	o, err := filepath.Abs(*outputPath)
 	if err != nil {
@@ -37,6 +107,14 @@ func main() {
 	}
 
 	env := golang.Default()
+	if *hermetic {
+		env, err = golang.LoadEnviron(env.GOROOT)
+		if err != nil {
+			l.Fatalf("Could not load Go environment: %v", err)
+		}
+		env.Hermetic = true
+		env.HermeticPATH = *hermeticPath
+	}
 	if env.CgoEnabled {
 		l.Printf("Disabling CGO for u-root...")
 		env.CgoEnabled = false
@@ -45,7 +123,8 @@ func main() {
 
 	tmpDir := *genDir
 	remove := false
-	if tmpDir == "" {
+	// VerifyReproducible makes its own directories.
+	if tmpDir == "" && !*verifyRepr {
 		tdir, err := ioutil.TempDir("", "bb-")
 		if err != nil {
 			l.Fatalf("Could not create busybox source directory: %v", err)
@@ -55,15 +134,43 @@ func main() {
 	}
 
 	opts := &bb.Opts{
-		Env:          env,
-		GenSrcDir:    tmpDir,
-		CommandPaths: flag.Args(),
-		BinaryPath:   o,
-		GoBuildOpts:  bopts,
-		GenerateOnly: *genOnly,
+		Env:            env,
+		GenSrcDir:      tmpDir,
+		CommandPaths:   flag.Args(),
+		Excludes:       excludes,
+		BinaryPath:     o,
+		GoBuildOpts:    bopts,
+		GenerateOnly:   *genOnly,
+		Vet:            *vet,
+		VetFatal:       *vetFatal,
+		LineDirectives: *lineDirs,
+		Strict:         *strict,
+		AllowExcluded:  allowExcluded,
+		AuditDeps:      *auditDeps,
+		NoUpgrades:     *noUpgrades,
+		LinkerVars:     linkerVars,
+	}
+	var diags diag.List
+	opts.OnDiagnostic = diags.Add
+
+	if *verifyRepr {
+		err = bb.VerifyReproducible(opts)
+	} else {
+		err = bb.BuildBusybox(opts)
+	}
+	if *jsonOut {
+		var preserved string
+		if err != nil {
+			preserved = tmpDir
+		}
+		writeReport(o, preserved, err, diags)
 	}
-	if err := bb.BuildBusybox(opts); err != nil {
+	if err != nil {
 		l.Print(err)
+		if *verifyRepr {
+			// The error says which generated source was kept.
+			os.Exit(1)
+		}
 		var errGopath *bb.ErrGopathBuild
 		var errGomod *bb.ErrModuleBuild
 		if errors.As(err, &errGopath) {
@@ -10,6 +10,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
 	"github.com/u-root/gobusybox/src/pkg/uflag"
@@ -20,11 +21,13 @@ var (
 	destDir  = flag.String("dest_dir", "", "Destination directory")
 	pkgFiles uflag.Strings
 	commands uflag.Strings
+	aliases  uflag.Strings
 )
 
 func init() {
 	flag.Var(&pkgFiles, "package_file", "package files")
 	flag.Var(&commands, "command", "Go package path for command to import")
+	flag.Var(&aliases, "alias", "alias=name: register alias as another name for command name")
 }
 
 func main() {
@@ -34,10 +37,27 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(astp) != 1 {
+		log.Fatalf("bb cmd template is supposed to only have one file, got %d", len(astp))
+	}
+	aliasNames := make(map[string]string)
+	for _, a := range aliases {
+		i := strings.Index(a, "=")
+		if i < 0 {
+			log.Fatalf("alias %q must be of the form alias=name", a)
+		}
+		if _, ok := aliasNames[a[:i]]; ok {
+			log.Fatalf("alias %q given twice", a[:i])
+		}
+		aliasNames[a[:i]] = a[i+1:]
+	}
+	if err := bbinternal.AddAliases(astp[0], aliasNames); err != nil {
+		log.Fatal(err)
+	}
 	if err := os.MkdirAll(*destDir, 0755); err != nil {
 		log.Fatal(err)
 	}
-	if err := bbinternal.CreateBBMainSource(fset, astp, commands, *destDir); err != nil {
+	if err := bbinternal.CreateBBMainSource(fset, astp, commands, *destDir, nil); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -4,16 +4,22 @@
 
 // rewritepkg takes a Go command's source and rewrites it to be a u-root
 // busybox compatible library package.
+//
+// With --test_source, the command's in-package tests are rewritten along with
+// it, so they can be run against the library package.
 package main
 
 import (
 	"flag"
 	"go/build"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"log"
 	"path/filepath"
 
-	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/bb/rewrite"
+	"github.com/u-root/gobusybox/src/pkg/golang"
 	"github.com/u-root/gobusybox/src/pkg/monoimporter"
 	"github.com/u-root/gobusybox/src/pkg/uflag"
 )
@@ -26,8 +32,12 @@ var (
 	goos          = flag.String("goos", "", "override GOOS of the resulting busybox")
 	installSuffix = flag.String("install_suffix", "", "override installsuffix of the resulting busybox")
 	bbImportPath  = flag.String("bb_import_path", "", "BB import path")
+	fullTypes     = flag.Bool("full_types", false, "type-check function bodies, too, and record all type information, as go/packages does")
+	goList        = flag.Bool("go_list", false, "(go) find export data of dependencies with `go list -export` in the directory of the source files, instead of in archives")
 
 	sourceFiles      uflag.Strings
+	testSourceFiles  uflag.Strings
+	archiveManifests uflag.Strings
 	stdlibZip        uflag.Strings
 	unmappedArchives uflag.Strings
 	stdlibArchives   uflag.Strings
@@ -39,7 +49,9 @@ func init() {
 	flag.Var(&unmappedArchives, "unmapped_archive", "(blaze) Go .a archives file paths for every dependency, where file path == import path")
 	flag.Var(&stdlibArchives, "stdlib_archive", "(bazel) Go standard library directory or paths for .a files")
 	flag.Var(&mappedArchives, "mapped_archive", "(bazel) list of goImportPath:goArchiveFilePath for every dependency")
+	flag.Var(&archiveManifests, "archive_manifest", "JSON manifest of import path -> archive file, for other build systems; see monoimporter.Manifest")
 	flag.Var(&sourceFiles, "source", "Source files")
+	flag.Var(&testSourceFiles, "test_source", "In-package (package main) _test.go files to rewrite along with the source files")
 }
 
 func main() {
@@ -56,10 +68,20 @@ func main() {
 	// bazel must pass stdlibArchives + mappedArchives.
 	//
 	// blaze must pass stdlibZip + unmappedArchives.
+	//
+	// Outside of either, --go_list gets export data from the go command.
+	//
+	// Other build systems pass --archive_manifest, which may also list the
+	// standard library.
 
-	if (len(stdlibZip) == 0 && len(stdlibArchives) == 0) || (len(stdlibZip) > 0 && len(stdlibArchives) > 0) {
+	if *goList {
+		if len(stdlibZip) > 0 || len(stdlibArchives) > 0 || len(unmappedArchives) > 0 || len(mappedArchives) > 0 {
+			log.Fatal("Cannot combine --go_list with archive options.")
+		}
+	} else if (len(stdlibZip) == 0 && len(stdlibArchives) == 0 && len(archiveManifests) == 0) || (len(stdlibZip) > 0 && len(stdlibArchives) > 0) {
 		log.Fatal("Must pass exactly one kind of stdlib option -- either --stdlib_zip or --stdlib_archive, " +
-			"but not neither nor both. More than one occurence of the chosen option is valid.")
+			"but not neither nor both. More than one occurence of the chosen option is valid. " +
+			"Neither is needed if the stdlib is in an --archive_manifest.")
 	}
 	if len(unmappedArchives) > 0 && len(mappedArchives) > 0 {
 		log.Fatal("Cannot pass both --mapped_archive and --unmapped_archive.")
@@ -84,8 +106,20 @@ func main() {
 		c.InstallSuffix = *installSuffix
 	}
 
+	// External test packages (package main_test) cannot import a
+	// command, so only in-package tests can be rewritten.
+	for _, path := range testSourceFiles {
+		f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if f.Name.Name != "main" {
+			log.Fatalf("rewritepkg: test file %s is in package %s; only package main tests can be rewritten", path, f.Name.Name)
+		}
+	}
+
 	var gofiles []string
-	for _, path := range sourceFiles {
+	for _, path := range append(sourceFiles, testSourceFiles...) {
 		dir, basename := filepath.Split(path)
 		// Check the file against build tags.
 		//
@@ -112,22 +146,52 @@ func main() {
 		}
 	}
 
-	imp, err := monoimporter.NewFromZips(c,
-		[]string(unmappedArchives),
-		[]string(mappedArchives),
-		[]string(stdlibArchives),
-		[]string(stdlibZip))
-	if err != nil {
-		log.Fatal(err)
+	var finders []monoimporter.Finder
+	for _, path := range archiveManifests {
+		m, err := monoimporter.ReadManifest(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		finders = append(finders, m)
 	}
+	if *goList {
+		if len(gofiles) == 0 {
+			log.Fatal("rewritepkg: no source files given")
+		}
+		env := golang.Default()
+		env.Context = c
+		exports, err := monoimporter.GoList(env, filepath.Dir(gofiles[0]), len(testSourceFiles) > 0, ".")
+		if err != nil {
+			log.Fatal(err)
+		}
+		finders = append(finders, exports)
+	} else {
+		archives, err := monoimporter.ArchiveFinders(c,
+			[]string(unmappedArchives),
+			[]string(mappedArchives),
+			[]string(stdlibArchives),
+			[]string(stdlibZip))
+		if err != nil {
+			log.Fatal(err)
+		}
+		finders = append(finders, archives...)
+	}
+	imp := monoimporter.NewFromFinders(finders...)
 
-	p, err := monoimporter.Load(*pkg, gofiles, imp)
+	mode := monoimporter.DeclsOnly
+	if *fullTypes {
+		mode = monoimporter.FullTypes
+	}
+	p, err := monoimporter.LoadMode(*pkg, gofiles, imp, mode)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bbPkg := bbinternal.NewPackage(*name, p)
-	if err := bbPkg.Rewrite(*destDir, *bbImportPath); err != nil {
+	if _, err := rewrite.Rewrite(p, rewrite.RewriteOptions{
+		Name:             *name,
+		BBMainImportPath: *bbImportPath,
+		Output:           rewrite.Dir(*destDir),
+	}); err != nil {
 		log.Fatalf("Rewriting failed: %v", err)
 	}
 }
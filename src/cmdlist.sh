@@ -0,0 +1,65 @@
+#!/bin/bash
+#
+# cmdlist.sh writes a .bzl file with a sorted list of all go_binary targets
+# matching bazel target patterns, for use as go_busybox cmds.
+#
+# Usage: cmdlist.sh -v VARNAME [-x EXCLUDE_PATTERN]... PATTERN... > cmds.bzl
+#
+# E.g.
+#
+#   src/cmdlist.sh -v CORE_CMDS -x //cmds/core/strace //cmds/core/... > cmds/core_cmds.bzl
+#
+# and in a BUILD file:
+#
+#   load("//cmds:core_cmds.bzl", "CORE_CMDS")
+#
+#   go_busybox(
+#       name = "bb",
+#       cmds = CORE_CMDS,
+#   )
+#
+# Rerun it when commands are added or removed.
+set -euo pipefail
+
+die() {
+  echo "$@" >&2
+  exit 1
+}
+
+VARNAME=""
+EXCLUDES=()
+while getopts "v:x:" opt; do
+  case "${opt}" in
+    v) VARNAME="${OPTARG}" ;;
+    x) EXCLUDES+=("${OPTARG}") ;;
+    *) die "usage: $0 -v VARNAME [-x EXCLUDE_PATTERN]... PATTERN..." ;;
+  esac
+done
+shift $((OPTIND - 1))
+
+if [[ -z "${VARNAME}" || $# -eq 0 ]]; then
+  die "usage: $0 -v VARNAME [-x EXCLUDE_PATTERN]... PATTERN..."
+fi
+
+QUERY="kind('go_binary rule', set($*))"
+FLAGS="-v ${VARNAME}"
+if [[ ${#EXCLUDES[@]} -gt 0 ]]; then
+  QUERY="${QUERY} except set(${EXCLUDES[*]})"
+  for x in "${EXCLUDES[@]}"; do
+    FLAGS="${FLAGS} -x ${x}"
+  done
+fi
+
+# Labels are shortened to //pkg if the target name is the directory name, and
+# sorted so that the list and the command names are stable.
+LABELS=$(bazel query --output=label "${QUERY}" |
+  sed -E 's|^(.*/)?([^/:]+):\2$|\1\2|' |
+  LC_ALL=C sort -u)
+
+echo "\"\"\"Generated by cmdlist.sh ${FLAGS} $*; DO NOT EDIT.\"\"\""
+echo
+echo "${VARNAME} = ["
+for label in ${LABELS}; do
+  echo "    \"${label}\","
+done
+echo "]"
@@ -1,11 +1,13 @@
 module github.com/u-root/gobusybox/src
 
-go 1.13
+go 1.25.0
 
 require (
 	github.com/google/goterm v0.0.0-20200907032337-555d40f16ae2
 	github.com/u-root/uio v0.0.0-20210528151154-e40b768296a7
-	golang.org/x/mod v0.4.2
-	golang.org/x/sys v0.0.0-20210525143221-35b2ab0089ea
-	golang.org/x/tools v0.0.0-20200904185747-39188db58858
+	golang.org/x/mod v0.35.0
+	golang.org/x/sys v0.43.0
+	golang.org/x/tools v0.44.0
 )
+
+require golang.org/x/sync v0.20.0 // indirect
@@ -11,9 +11,8 @@ Example usage to create a busybox binary:
   )
 """
 
-load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_context", "go_library")
-load("@io_bazel_rules_go//go/private/rules:transition.bzl", "go_transition_rule")
-load("@io_bazel_rules_go//go/private:providers.bzl", "GoArchive", "GoLibrary", "GoSource")
+load("@io_bazel_rules_go//go:def.bzl", "GoArchive", "GoInfo", "go_context", "go_rule", "go_test", "new_go_info")
+load("@io_bazel_rules_go//go/private/rules:transition.bzl", "go_transition")
 load(
     "@io_bazel_rules_go//go/platform:list.bzl",
     "GOARCH",
@@ -25,7 +24,10 @@ GoBusyboxLibrary = provider(
     fields = ["command_name"],
 )
 GoBusyboxBinary = provider(
-    fields = ["command_names", "executable"],
+    fields = {
+        "command_names": "all names the busybox runs a command for, including aliases",
+        "executable": "the busybox binary",
+    },
 )
 
 def _go_dep_aspect(target, ctx):
@@ -51,25 +53,30 @@ go_dep_aspect = aspect(
     provides = [GoDepInfo],
 )
 
-def _go_busybox_library(ctx):
-    """Rewrite one Go command to be a library.
-
-    It will take a go_binary's source files and rewrite them to be compatible
-    with u-root's busybox mode as a library.
+def _rewrite_cmd(ctx, gen_dir, test_srcs = [], test_deps = []):
+    """Rewrites ctx.attr.cmd, and optionally its tests, to be a library.
 
     Args:
       ctx: rule context
+      gen_dir: directory next to the command's sources to write the
+        rewritten files to.
+      test_srcs: in-package _test.go files of the command to rewrite along
+        with it.
+      test_deps: Go libraries that test_srcs depend on.
 
     Returns:
-      GoLibrary, GoSource, GoArchive like a normal go_library
+      GoInfo, GoArchive like a normal go_library
     """
+    cmd = ctx.attr.cmd[GoArchive].source
+    command_name = ctx.attr.command_name or cmd.name
     args = ctx.actions.args()
-    args.add("--name", ctx.attr.cmd[GoLibrary].name)
+    args.add("--name", command_name)
     args.add("--bb_import_path", "github.com/u-root/gobusybox/src/pkg/bb/bbmain")
 
     go = go_context(ctx)
-    for archive in go.stdlib.libs:
-        args.add("--stdlib_archive", archive.path)
+
+    # The standard library is one directory of .a files.
+    args.add_all("--stdlib_archive", go.stdlib.libs, expand_directories = False)
 
     output_dir = None
     outputs = []
@@ -78,81 +85,152 @@ def _go_busybox_library(ctx):
     transitiveDepTargets = []
     importpath = None
 
-    importpath = ctx.attr.cmd[GoLibrary].importpath
-    for deparchive in ctx.attr.cmd[GoArchive].direct:
-        args.add("--mapped_archive", "%s:%s" % (deparchive.data.importpath, deparchive.data.file.path))
-        depInputs.append(deparchive.data.file)
+    importpath = cmd.importpath
+    direct = ctx.attr.cmd[GoArchive].direct + [dep[GoArchive] for dep in test_deps]
+
+    # The export data of a package is in export_file; file only has what
+    # the linker needs.
+    for deparchive in direct:
+        args.add("--mapped_archive", "%s:%s" % (deparchive.data.importpath, deparchive.data.export_file.path))
+        depInputs.append(deparchive.data.export_file)
 
     # Transitive dependencies of the direct dependency.
-    for tdep in ctx.attr.cmd[GoArchive].transitive.to_list():
-        args.add("--mapped_archive", "%s:%s" % (tdep.importpath, tdep.file.path))
-        depInputs.append(tdep.file)
+    transitive = [ctx.attr.cmd[GoArchive].transitive] + [dep[GoArchive].transitive for dep in test_deps]
+    for tdep in depset(transitive = transitive).to_list():
+        args.add("--mapped_archive", "%s:%s" % (tdep.importpath, tdep.export_file.path))
+        depInputs.append(tdep.export_file)
 
     transitiveDepTargets = ctx.attr.cmd[GoDepInfo].targets
 
-    for f in ctx.attr.cmd[GoSource].srcs:
-        args.add("--source", f.path)
+    srcs = [("--source", f) for f in cmd.srcs]
+    srcs += [("--test_source", f) for f in test_srcs]
+    for flag, f in srcs:
+        args.add(flag, f.path)
         inputSrcs.append(f)
 
         # This relies on f.basename being relative to output_dir, which
         # they should be since they're relative to gen.. It's a
         # bit of a hack.
-        outf = go.actions.declare_file("%s/gen2/%s" % (f.dirname, f.basename))
+        outf = go.actions.declare_file("%s/%s/%s" % (f.dirname, gen_dir, f.basename))
         outputs.append(outf)
         if not output_dir:
             output_dir = outf.dirname
 
     args.add("--dest_dir", output_dir)
 
-    # go.sdk.goarch/goos seem to have host values? Why do those differ form the
-    # go.env values?
+    # go.sdk.goarch/goos are those of the SDK, i.e. the host. go.env has the
+    # target platform of the configuration this library is built in, which
+    # the go_busybox that depends on it may have transitioned to with its
+    # goos/goarch attributes.
     args.add("--goarch", go.env["GOARCH"])
     args.add("--goos", go.env["GOOS"])
 
     # Run the rewritepkg binary.
     ctx.actions.run(
-        inputs = depset(inputSrcs, transitive = [depset(depInputs), depset(go.stdlib.libs)]),
+        inputs = depset(inputSrcs, transitive = [depset(depInputs), go.stdlib.libs]),
         outputs = outputs,
         arguments = [args],
         executable = ctx.executable._rewrite_ast,
     )
 
-    library = go.new_library(
+    go_info = new_go_info(
+        go,
+        struct(),
         name = ctx.attr.name,
-        go = go,
         importpath = "%s_bb" % importpath,
-        srcs = outputs,
+        generated_srcs = outputs,
+        deps = [dep[GoArchive] for dep in transitiveDepTargets + test_deps + ctx.attr._new_deps],
     )
-    attr = struct(
-        deps = transitiveDepTargets + ctx.attr._new_deps,
-        cgo = False,
-    )
-    source = go.library_to_source(go, attr, library, ctx.coverage_instrumented())
-    archive = go.archive(go, source)
+    archive = go.archive(go, go_info)
     return [
-        library,
-        source,
+        go_info,
         archive,
         GoBusyboxLibrary(
-            command_name = ctx.attr.cmd[GoLibrary].name,
+            command_name = command_name,
         ),
     ]
 
-go_busybox_library = rule(
+def _go_busybox_library(ctx):
+    """Rewrite one Go command to be a library.
+
+    It will take a go_binary's source files and rewrite them to be compatible
+    with u-root's busybox mode as a library.
+
+    Args:
+      ctx: rule context
+
+    Returns:
+      GoInfo, GoArchive like a normal go_library
+    """
+    return _rewrite_cmd(ctx, "gen2")
+
+def _go_busybox_test_library(ctx):
+    """Rewrite one Go command and its in-package tests to be a library.
+
+    Args:
+      ctx: rule context
+
+    Returns:
+      GoInfo, GoArchive to embed in a go_test
+    """
+    return _rewrite_cmd(ctx, "%s_gen" % ctx.label.name, ctx.files.srcs, ctx.attr.deps)
+
+go_busybox_library = go_rule(
     implementation = _go_busybox_library,
     attrs = {
         "cmd": attr.label(
             mandatory = True,
-            providers = [GoDepInfo, GoSource, GoLibrary, GoArchive],
+            providers = [GoDepInfo, GoArchive],
+            allow_rules = ["go_binary"],
+            aspects = [go_dep_aspect],
+        ),
+        "command_name": attr.string(
+            doc = "Name of the command in the busybox. Defaults to the name of cmd.",
+        ),
+        "_stdlib": attr.label(
+            default = Label("@io_bazel_rules_go//:stdlib"),
+        ),
+        "_rewrite_ast": attr.label(
+            executable = True,
+            cfg = "exec",
+            allow_files = True,
+            default = Label("//src/cmd/rewritepkg"),
+        ),
+        "_new_deps": attr.label_list(
+            default = ["//src/pkg/bb/bbmain"],
+        ),
+        "_go_context_data": attr.label(
+            default = "@io_bazel_rules_go//:go_context_data",
+        ),
+    },
+)
+
+_go_busybox_test_library = go_rule(
+    implementation = _go_busybox_test_library,
+    attrs = {
+        "cmd": attr.label(
+            mandatory = True,
+            providers = [GoDepInfo, GoArchive],
             allow_rules = ["go_binary"],
             aspects = [go_dep_aspect],
         ),
+        "srcs": attr.label_list(
+            allow_files = ["_test.go"],
+            doc = "In-package _test.go files of cmd.",
+        ),
+        "deps": attr.label_list(
+            providers = [GoArchive],
+            doc = "Go libraries the tests depend on besides cmd's dependencies.",
+        ),
+        "command_name": attr.string(
+            doc = "Name of the command in the busybox. Defaults to the name of cmd.",
+        ),
         "_stdlib": attr.label(
             default = Label("@io_bazel_rules_go//:stdlib"),
         ),
         "_rewrite_ast": attr.label(
             executable = True,
-            cfg = "host",
+            cfg = "exec",
             allow_files = True,
             default = Label("//src/cmd/rewritepkg"),
         ),
@@ -163,9 +241,18 @@ go_busybox_library = rule(
             default = "@io_bazel_rules_go//:go_context_data",
         ),
     },
-    toolchains = ["@io_bazel_rules_go//go:toolchain"],
 )
 
+# Names that commands and aliases cannot have, and what they are used for.
+_RESERVED_NAMES = {
+    "bb": "the busybox binary itself",
+    "bbdiagnose": "the busybox's built-in command listing",
+}
+
+def _check_reserved(name, what):
+    if name in _RESERVED_NAMES:
+        fail("%s cannot be named '%s', which is reserved for %s" % (what, name, _RESERVED_NAMES[name]))
+
 def _go_busybox_impl(ctx):
     """_go_busybox_impl creates + compiles the main.go dispatcher.
 
@@ -196,12 +283,30 @@ def _go_busybox_impl(ctx):
 
     args.add("--dest_dir", output_dir)
 
+    # Command names must be unique. Checking them here fails the build
+    # before bbmain.Register panics at run time.
     cmd_names = []
+    seen = {}
 
     # Stuff to import.
     for cmd in ctx.attr.cmds:
-        args.add("--command", cmd[GoLibrary].importpath)
-        cmd_names.append(cmd[GoBusyboxLibrary].command_name)
+        args.add("--command", cmd[GoInfo].importpath)
+        cmd_name = cmd[GoBusyboxLibrary].command_name
+        _check_reserved(cmd_name, "Command %s" % cmd.label)
+        if cmd_name in seen:
+            fail("Two commands have the same name '%s': %s and %s" % (cmd_name, seen[cmd_name], cmd.label))
+        seen[cmd_name] = cmd.label
+        cmd_names.append(cmd_name)
+
+    for alias, cmd_name in sorted(ctx.attr.aliases.items()):
+        _check_reserved(alias, "Alias for '%s'" % cmd_name)
+        if alias in seen:
+            fail("Alias '%s' for '%s' is already the name of %s" % (alias, cmd_name, seen[alias]))
+        if cmd_name not in cmd_names:
+            fail("Alias '%s' is for unknown command '%s'" % (alias, cmd_name))
+        args.add("--alias", "%s=%s" % (alias, cmd_name))
+        seen[alias] = "an alias"
+        cmd_names.append(alias)
 
     # Run the make_main binary.
     ctx.actions.run(
@@ -211,25 +316,26 @@ def _go_busybox_impl(ctx):
         executable = ctx.executable._make_main,
     )
 
-    go = go_context(ctx)
-    library = go.new_library(
-        go = go,
-        importable = True,
-        srcs = outputs,
-        is_main = True,
+    go = go_context(
+        ctx,
+        goos = ctx.attr.goos,
+        goarch = ctx.attr.goarch,
+        static = ctx.attr.static,
     )
-    attr = struct(
-        deps = ctx.attr.cmds + ctx.attr._template[GoDepInfo].targets,
+    go_info = new_go_info(
+        go,
+        struct(),
+        generated_srcs = outputs,
+        is_main = True,
+        deps = [dep[GoArchive] for dep in ctx.attr.cmds + ctx.attr._template[GoDepInfo].targets],
     )
-    source = go.library_to_source(go, attr, library, ctx.coverage_instrumented())
     archive, executable, runfiles = go.binary(
-        go = go,
+        go,
         name = ctx.attr.name,
-        source = source,
+        source = go_info,
     )
     return [
-        library,
-        source,
+        go_info,
         archive,
         OutputGroupInfo(
             compilation_outputs = [archive.data.file],
@@ -245,12 +351,15 @@ def _go_busybox_impl(ctx):
         ),
     ]
 
-_go_busybox = go_transition_rule(
+_go_busybox = go_rule(
     attrs = {
         "cmds": attr.label_list(
             mandatory = True,
             allow_rules = ["go_busybox_library"],
         ),
+        "aliases": attr.string_dict(
+            doc = "Additional names for commands, as alias -> command name.",
+        ),
         "_template": attr.label(
             providers = [GoArchive, GoDepInfo],
             allow_rules = ["go_binary"],
@@ -259,35 +368,291 @@ _go_busybox = go_transition_rule(
         ),
         "_make_main": attr.label(
             executable = True,
-            cfg = "host",
+            cfg = "exec",
             allow_files = True,
             default = Label("//src/cmd/makebbmain"),
         ),
         "_go_context_data": attr.label(
             default = "@io_bazel_rules_go//:go_context_data",
         ),
+
+        # The attributes go_transition reads, as on go_binary.
+        "goos": attr.string(default = "auto"),
+        "goarch": attr.string(default = "auto"),
+        "pure": attr.string(default = "auto"),
+        "static": attr.string(default = "auto"),
+        "race": attr.string(default = "auto"),
+        "msan": attr.string(default = "auto"),
+        "gotags": attr.string_list(),
+        "linkmode": attr.string(default = "auto"),
+        "_allowlist_function_transition": attr.label(
+            default = "@bazel_tools//tools/allowlists/function_transition_allowlist",
+        ),
     },
+    cfg = go_transition,
     executable = True,
     implementation = _go_busybox_impl,
-    toolchains = ["@io_bazel_rules_go//go:toolchain"],
 )
 
-def go_busybox(name, cmds = [], **kwargs):
-    rewrittenCmds = []
-    cmd_names = []
+def _go_busybox_archive_impl(ctx):
+    """Writes the install tree of a go_busybox to tar and/or cpio archives.
+
+    Args:
+        ctx: rule context.
+
+    Returns:
+        The archives.
+    """
+    bb = ctx.attr.busybox[GoBusyboxBinary]
+
+    args = ctx.actions.args()
+    args.add("--busybox", bb.executable.path)
+    args.add("--links", ctx.attr.links)
+    for name in bb.command_names:
+        args.add("--command", name)
+
+    outputs = []
+    for format in ctx.attr.formats:
+        if format not in ("cpio", "tar"):
+            fail("Unknown archive format '%s'; must be cpio or tar" % format)
+        out = ctx.actions.declare_file("%s.%s" % (ctx.attr.name, format))
+        args.add("--%s" % format, out.path)
+        outputs.append(out)
+    if not outputs:
+        fail("No archive formats given")
+
+    ctx.actions.run(
+        inputs = [bb.executable],
+        outputs = outputs,
+        arguments = [args],
+        executable = ctx.executable._bbarchive,
+        mnemonic = "GoBusyboxArchive",
+    )
+    return [DefaultInfo(files = depset(outputs))]
+
+go_busybox_archive = rule(
+    doc = """Creates reproducible archives of a busybox install tree.
+
+    The archives contain bbin/bb and, per command, bbin/<cmd> as a symlink to
+    bb or as a "#!/bbin/bb #!<cmd>" file. All files have a zero mtime and are
+    owned by uid and gid 0. A newc cpio archive can be used as (part of) a
+    Linux initramfs.
+    """,
+    implementation = _go_busybox_archive_impl,
+    attrs = {
+        "busybox": attr.label(
+            mandatory = True,
+            providers = [GoBusyboxBinary],
+            doc = "The go_busybox target.",
+        ),
+        "formats": attr.string_list(
+            default = ["cpio"],
+            doc = "Archives to create: cpio (name.cpio) and/or tar (name.tar).",
+        ),
+        "links": attr.string(
+            default = "symlink",
+            values = ["symlink", "script"],
+            doc = "How commands are linked to bb: symlinks or #! files.",
+        ),
+        "_bbarchive": attr.label(
+            executable = True,
+            cfg = "exec",
+            default = Label("//src/cmd/bbarchive"),
+        ),
+    },
+)
+
+def _normalize_label(label):
+    """Returns label in the absolute form [@repo]//pkg:name."""
+    if label.startswith(":"):
+        label = "//%s%s" % (native.package_name(), label)
+    if ":" not in label.split("//", 1)[-1]:
+        label = "%s:%s" % (label, label.rsplit("/", 1)[-1])
+    return label
+
+def _package_go_binaries():
+    """Returns the go_binary targets defined so far in the current package.
+
+    Macros only see rules declared before them, so go_binary targets declared
+    after the go_busybox call are missing.
+    """
+    return [
+        "//%s:%s" % (native.package_name(), r["name"])
+        for r in native.existing_rules().values()
+        if r["kind"] == "go_binary"
+    ]
+
+def _expand_cmds(cmds, exclude):
+    """Expands cmds into a sorted, deduplicated list of go_binary labels.
+
+    The :all and :* target patterns of the current package, e.g. :all or
+    //pkg:all, expand to all go_binary targets defined in it before the
+    go_busybox call.
+
+    Args:
+      cmds: go_binary labels or patterns.
+      exclude: go_binary labels to leave out.
+
+    Returns:
+      Labels in the absolute form [@repo]//pkg:name.
+    """
+    excluded = {_normalize_label(x): True for x in exclude}
+    current = [_normalize_label(p) for p in (":all", ":*")]
+    labels = {}
     for c in cmds:
-        cl = Label(c)
-        if cl.name in cmd_names:
-            fail("Two commands have the same name '%s'" % cl.name)
+        if not c.endswith("/...") and _normalize_label(c) in current:
+            expanded = _package_go_binaries()
+        elif c.endswith("/...") or c.endswith(":all") or c.endswith(":*"):
+            fail("go_busybox can only expand :all in the current package, not %s; generate a label list with src/cmdlist.sh instead" % c)
+        else:
+            expanded = [c]
+        for label in expanded:
+            label = _normalize_label(label)
+            if label not in excluded:
+                labels[label] = True
+    return sorted(labels.keys())
+
+def _check_platform(goos, goarch):
+    if goos != "auto" and goos not in GOOS:
+        fail("Unknown goos '%s'" % goos)
+    if goarch != "auto" and goarch not in GOARCH:
+        fail("Unknown goarch '%s'" % goarch)
+
+def go_busybox(name, cmds = [], exclude = [], cmd_names = {}, aliases = {}, goos = "auto", goarch = "auto", pure = "auto", platforms = [], **kwargs):
+    """Creates a busybox of Go commands.
+
+    Like go_binary, the busybox can be built for another platform with goos,
+    goarch and pure. The commands are rewritten and compiled for that
+    platform, too.
+
+    With platforms, one busybox per platform is created, named
+    <name>_<goos>_<goarch>, and <name> is a filegroup of all of them, so that
+    one build produces busyboxes for several architectures side by side.
+
+    :all is expanded when the BUILD file is loaded, from the rules declared
+    so far: go_binary targets declared after the go_busybox call are silently
+    left out, so declare go_busybox last. Other packages and subtrees such as
+    //cmds/... cannot be expanded by a macro at all. src/cmdlist.sh writes
+    their go_binary labels to a .bzl file, which is a snapshot and must be
+    regenerated when commands are added or removed; CI checks that
+    src/bazeltest/cmds.bzl is up to date this way.
+
+    Args:
+      name: name of the busybox binary target.
+      cmds: go_binary labels. :all stands for all go_binary targets declared
+        above the go_busybox call in the current package; for other
+        packages and subtrees, see src/cmdlist.sh.
+      exclude: go_binary labels not to include, e.g. from an expanded :all.
+      cmd_names: command names for go_binary labels in cmds, if they should
+        differ from the target name.
+      aliases: additional names for commands, as alias -> command name.
+      goos: GOOS to build the busybox for, or "auto" for the target platform.
+      goarch: GOARCH to build the busybox for, or "auto" for the target
+        platform.
+      pure: "on" to build without cgo, "off" to build with cgo, or "auto".
+      platforms: <goos>_<goarch> platforms, e.g. linux_arm64, to build a
+        busybox for each. Cannot be combined with goos and goarch.
+      **kwargs: passed to the busybox binary rule.
+    """
+    _check_platform(goos, goarch)
+    expanded = _expand_cmds(cmds, exclude)
+    renames = {}
+    for label, cmd_name in cmd_names.items():
+        label = _normalize_label(label)
+        if label not in expanded:
+            fail("cmd_names has a name for %s, which is not in cmds" % label)
+        renames[label] = cmd_name
+
+    rewrittenCmds = []
+    names = {}
+    for c in expanded:
+        cmd_name = renames.get(c, c.rsplit(":", 1)[1])
+        _check_reserved(cmd_name, "Command %s" % c)
+        if cmd_name in names:
+            fail("Two commands have the same name '%s': %s and %s" % (cmd_name, names[cmd_name], c))
+        names[cmd_name] = c
 
         go_busybox_library(
-            name = "%s_%s" % (name, cl.name),
+            name = "%s_%s" % (name, cmd_name),
             cmd = c,
+            command_name = cmd_name,
         )
-        rewrittenCmds.append(":%s_%s" % (name, cl.name))
+        rewrittenCmds.append(":%s_%s" % (name, cmd_name))
+
+    for alias, cmd_name in aliases.items():
+        _check_reserved(alias, "Alias for '%s'" % cmd_name)
+        if alias in names:
+            fail("Alias '%s' for '%s' is already the name of %s" % (alias, cmd_name, names[alias]))
+        if cmd_name not in names:
+            fail("Alias '%s' is for unknown command '%s'" % (alias, cmd_name))
+
+    if not platforms:
+        _go_busybox(
+            name = name,
+            cmds = rewrittenCmds,
+            aliases = aliases,
+            goos = goos,
+            goarch = goarch,
+            pure = pure,
+            **kwargs
+        )
+        return
+
+    if goos != "auto" or goarch != "auto":
+        fail("platforms cannot be combined with goos or goarch")
+    busyboxes = []
+    for platform in platforms:
+        parts = platform.split("_")
+        if len(parts) != 2:
+            fail("Platform '%s' must be of the form <goos>_<goarch>" % platform)
+        _check_platform(parts[0], parts[1])
+        _go_busybox(
+            name = "%s_%s" % (name, platform),
+            cmds = rewrittenCmds,
+            aliases = aliases,
+            goos = parts[0],
+            goarch = parts[1],
+            pure = pure,
+            **kwargs
+        )
+        busyboxes.append(":%s_%s" % (name, platform))
 
-    _go_busybox(
+    native.filegroup(
+        name = name,
+        srcs = busyboxes,
+        visibility = kwargs.get("visibility"),
+    )
+
+def go_busybox_test(name, cmd, srcs = [], deps = [], command_name = None, **kwargs):
+    """Runs a command's tests against its busybox-rewritten library.
+
+    The in-package (package main) _test.go files in srcs are rewritten along
+    with cmd's sources, the same way go_busybox rewrites cmd, and compiled
+    into a go_test. The tests thereby check that rewriting did not change
+    the command's behavior.
+
+    External test packages (package main_test) cannot import a command and
+    are not supported.
+
+    Args:
+      name: name of the go_test.
+      cmd: go_binary label of the command.
+      srcs: in-package _test.go files of cmd.
+      deps: Go libraries the tests depend on besides cmd's dependencies.
+      command_name: name of the command in the busybox, if it differs from
+        the name of cmd.
+      **kwargs: passed to go_test, e.g. data or size.
+    """
+    _go_busybox_test_library(
+        name = "%s_bb" % name,
+        cmd = cmd,
+        srcs = srcs,
+        deps = deps,
+        command_name = command_name,
+        testonly = True,
+    )
+    go_test(
         name = name,
-        cmds = rewrittenCmds,
+        embed = [":%s_bb" % name],
         **kwargs
     )
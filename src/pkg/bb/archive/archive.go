@@ -0,0 +1,195 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package archive writes the install tree of a busybox, /bbin/bb plus one
+// link per command, as reproducible tar or newc cpio archives.
+//
+// All entries have a zero modification time and are owned by uid and gid 0,
+// so the same busybox and commands always yield the same archive bytes.
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+// LinkType is how commands are linked to the busybox binary.
+type LinkType string
+
+const (
+	// Symlink links bbin/<cmd> to bb with a relative symlink.
+	Symlink LinkType = "symlink"
+
+	// Script makes bbin/<cmd> a "#!/bbin/bb #!<cmd>" interpreter file,
+	// for file systems without symlinks. See bbmain/cmd/main.go.
+	Script LinkType = "script"
+)
+
+// Dir is the directory of the busybox and its command links.
+const Dir = "bbin"
+
+// Type is the type of an Entry.
+type Type int
+
+const (
+	// TypeDir is a directory.
+	TypeDir Type = iota
+
+	// TypeFile is a regular file.
+	TypeFile
+
+	// TypeSymlink is a symlink.
+	TypeSymlink
+)
+
+// Entry is a file in the install tree.
+type Entry struct {
+	// Name is the slash-separated path relative to the archive root.
+	Name string
+	Type Type
+
+	// Perm are the permission bits.
+	Perm uint32
+
+	// Data is the content of a regular file.
+	Data []byte
+
+	// Linkname is the target of a symlink.
+	Linkname string
+}
+
+// Entries returns the install tree of the busybox binary bb with the
+// commands cmds, sorted by name.
+func Entries(bb []byte, cmds []string, links LinkType) ([]Entry, error) {
+	entries := []Entry{
+		{Name: Dir, Type: TypeDir, Perm: 0755},
+		{Name: path.Join(Dir, "bb"), Type: TypeFile, Perm: 0755, Data: bb},
+	}
+	seen := map[string]struct{}{"bb": {}}
+	for _, cmd := range cmds {
+		if cmd == "" || cmd == "." || cmd == ".." || path.Base(cmd) != cmd {
+			return nil, fmt.Errorf("invalid command name %q", cmd)
+		}
+		if _, ok := seen[cmd]; ok {
+			return nil, fmt.Errorf("duplicate command name %q", cmd)
+		}
+		seen[cmd] = struct{}{}
+
+		name := path.Join(Dir, cmd)
+		switch links {
+		case Symlink:
+			entries = append(entries, Entry{Name: name, Type: TypeSymlink, Perm: 0777, Linkname: "bb"})
+		case Script:
+			entries = append(entries, Entry{Name: name, Type: TypeFile, Perm: 0755, Data: []byte(fmt.Sprintf("#!/%s/bb #!%s\n", Dir, cmd))})
+		default:
+			return nil, fmt.Errorf("unknown link type %q", links)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// WriteTar writes entries as a tar archive to w.
+func WriteTar(w io.Writer, entries []Entry) error {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:    e.Name,
+			Mode:    int64(e.Perm),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatUSTAR,
+		}
+		switch e.Type {
+		case TypeDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case TypeFile:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(e.Data))
+		case TypeSymlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.Linkname
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if e.Type == TypeFile {
+			if _, err := tw.Write(e.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// Mode bits of the file types in cpio headers.
+const (
+	modeDir     = 0040000
+	modeFile    = 0100000
+	modeSymlink = 0120000
+)
+
+// cpioTrailer is the name of the last entry of a cpio archive.
+const cpioTrailer = "TRAILER!!!"
+
+// WriteCPIO writes entries as a newc ("070701") cpio archive, the format
+// of Linux initramfs archives, to w.
+//
+// Inode numbers are assigned in order of entries, starting at 1.
+func WriteCPIO(w io.Writer, entries []Entry) error {
+	cw := &cpioWriter{w: w}
+	for i, e := range entries {
+		var mode, nlink uint32
+		data := e.Data
+		switch e.Type {
+		case TypeDir:
+			mode, nlink = modeDir, 2
+		case TypeFile:
+			mode, nlink = modeFile, 1
+		case TypeSymlink:
+			mode, nlink = modeSymlink, 1
+			data = []byte(e.Linkname)
+		}
+		cw.record(uint32(i+1), mode|e.Perm, nlink, e.Name, data)
+	}
+	cw.record(0, 0, 1, cpioTrailer, nil)
+	return cw.err
+}
+
+type cpioWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *cpioWriter) write(b []byte) {
+	if cw.err != nil {
+		return
+	}
+	var n int
+	n, cw.err = cw.w.Write(b)
+	cw.n += int64(n)
+}
+
+// pad writes zeros up to the next multiple of 4 bytes.
+func (cw *cpioWriter) pad() {
+	if r := cw.n % 4; r != 0 {
+		cw.write(make([]byte, 4-r))
+	}
+}
+
+func (cw *cpioWriter) record(ino, mode, nlink uint32, name string, data []byte) {
+	// magic, ino, mode, uid, gid, nlink, mtime, filesize, devmajor,
+	// devminor, rdevmajor, rdevminor, namesize, check.
+	cw.write([]byte(fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		ino, mode, 0, 0, nlink, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)))
+	cw.write(append([]byte(name), 0))
+	cw.pad()
+	cw.write(data)
+	cw.pad()
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestEntries(t *testing.T) {
+	bb := []byte("ELF")
+	for _, tt := range []struct {
+		name  string
+		cmds  []string
+		links LinkType
+		want  []Entry
+	}{
+		{
+			name:  "symlinks",
+			cmds:  []string{"ls", "cat"},
+			links: Symlink,
+			want: []Entry{
+				{Name: "bbin", Type: TypeDir, Perm: 0755},
+				{Name: "bbin/bb", Type: TypeFile, Perm: 0755, Data: bb},
+				{Name: "bbin/cat", Type: TypeSymlink, Perm: 0777, Linkname: "bb"},
+				{Name: "bbin/ls", Type: TypeSymlink, Perm: 0777, Linkname: "bb"},
+			},
+		},
+		{
+			name:  "scripts",
+			cmds:  []string{"ls"},
+			links: Script,
+			want: []Entry{
+				{Name: "bbin", Type: TypeDir, Perm: 0755},
+				{Name: "bbin/bb", Type: TypeFile, Perm: 0755, Data: bb},
+				{Name: "bbin/ls", Type: TypeFile, Perm: 0755, Data: []byte("#!/bbin/bb #!ls\n")},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Entries(bb, tt.cmds, tt.links)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Entries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, cmds := range [][]string{{"ls", "ls"}, {"bb"}, {"../ls"}, {""}} {
+		if _, err := Entries(bb, cmds, Symlink); err == nil {
+			t.Errorf("Entries(%q) = nil, want error", cmds)
+		}
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	entries, err := Entries([]byte("ELF"), []string{"ls"}, Symlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b bytes.Buffer
+	if err := WriteTar(&a, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTar(&b, entries); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("WriteTar is not reproducible")
+	}
+
+	r := tar.NewReader(&a)
+	var names []string
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.ModTime.Unix() != 0 || hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Errorf("%s: mtime %v, uid %d, gid %d, want 0", hdr.Name, hdr.ModTime, hdr.Uid, hdr.Gid)
+		}
+		if hdr.Name == "bbin/ls" && (hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "bb") {
+			t.Errorf("bbin/ls = type %c -> %q, want symlink to bb", hdr.Typeflag, hdr.Linkname)
+		}
+		names = append(names, hdr.Name)
+	}
+	if want := []string{"bbin/", "bbin/bb", "bbin/ls"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("tar entries = %v, want %v", names, want)
+	}
+}
+
+type cpioRecord struct {
+	ino, mode, nlink uint32
+	name             string
+	data             string
+}
+
+// readCPIO parses a newc cpio archive.
+func readCPIO(t *testing.T, b []byte) []cpioRecord {
+	t.Helper()
+	field := func(off int) uint32 {
+		v, err := strconv.ParseUint(string(b[off:off+8]), 16, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uint32(v)
+	}
+	align := func(n int) int { return (n + 3) &^ 3 }
+
+	var records []cpioRecord
+	for off := 0; ; {
+		if string(b[off:off+6]) != "070701" {
+			t.Fatalf("bad magic at offset %d", off)
+		}
+		size := int(field(off + 6 + 6*8))
+		namesize := int(field(off + 6 + 11*8))
+		r := cpioRecord{
+			ino:   field(off + 6),
+			mode:  field(off + 6 + 8),
+			nlink: field(off + 6 + 4*8),
+		}
+		nameOff := off + 110
+		r.name = string(b[nameOff : nameOff+namesize-1])
+		dataOff := align(nameOff + namesize)
+		r.data = string(b[dataOff : dataOff+size])
+		off = align(dataOff + size)
+		if r.name == cpioTrailer {
+			if off != len(b) {
+				t.Errorf("%d bytes after trailer", len(b)-off)
+			}
+			return records
+		}
+		records = append(records, r)
+	}
+}
+
+func TestWriteCPIO(t *testing.T) {
+	entries, err := Entries([]byte("ELF binary"), []string{"ls", "cat"}, Symlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := WriteCPIO(&b, entries); err != nil {
+		t.Fatal(err)
+	}
+	want := []cpioRecord{
+		{ino: 1, mode: 040755, nlink: 2, name: "bbin"},
+		{ino: 2, mode: 0100755, nlink: 1, name: "bbin/bb", data: "ELF binary"},
+		{ino: 3, mode: 0120777, nlink: 1, name: "bbin/cat", data: "bb"},
+		{ino: 4, mode: 0120777, nlink: 1, name: "bbin/ls", data: "bb"},
+	}
+	if got := readCPIO(t, b.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("cpio records = %v, want %v", got, want)
+	}
+}
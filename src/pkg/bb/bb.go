@@ -24,35 +24,111 @@
 package bb
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/google/goterm/term"
 	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/packages"
 
 	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/bb/bbvet"
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
 	"github.com/u-root/gobusybox/src/pkg/bb/findpkg"
+	"github.com/u-root/gobusybox/src/pkg/bb/genfs"
+	"github.com/u-root/gobusybox/src/pkg/bb/srcmap"
 	"github.com/u-root/gobusybox/src/pkg/golang"
-	"github.com/u-root/uio/cp"
 )
 
+// listStrings returns the keys of m in sorted order.
 func listStrings(m map[string]struct{}) []string {
 	var l []string
 	for k := range m {
 		l = append(l, k)
 	}
+	sort.Strings(l)
 	return l
 }
 
+// modulePaths returns the module paths of m in sorted order.
+func modulePaths(m map[string]*packages.Module) []string {
+	var l []string
+	for k := range m {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func numCmds(hazards []bbvet.Hazard) int {
+	cmds := make(map[string]struct{})
+	for _, h := range hazards {
+		cmds[h.Cmd] = struct{}{}
+	}
+	return len(cmds)
+}
+
+// checkSkipped returns an error listing all skipped commands, except those
+// excluded by build constraints that are on the allowExcluded list.
+func checkSkipped(skipped []*diag.SkippedCommand, allowExcluded []string) error {
+	allowed := make(map[string]struct{})
+	for _, a := range allowExcluded {
+		allowed[a] = struct{}{}
+		if abs, err := filepath.Abs(a); err == nil {
+			allowed[abs] = struct{}{}
+		}
+	}
+
+	var errs []*diag.SkippedCommand
+	for _, s := range skipped {
+		if _, ok := allowed[s.Path]; ok && s.Reason == diag.BuildConstraints {
+			continue
+		}
+		errs = append(errs, s)
+	}
+	if len(errs) > 0 {
+		return &ErrSkippedCommands{Skipped: errs}
+	}
+	return nil
+}
+
+// checkUpgrades logs and reports all dependency versions of cmds that change
+// in the busybox module in bbDir. If fatal, changes are returned as an
+// *ErrDependencyUpgrades.
+func checkUpgrades(env golang.Environ, bbDir string, cmds []*bbinternal.Package, fatal bool, report diag.Handler) error {
+	bl, err := buildList(env, bbDir)
+	if err != nil {
+		return fmt.Errorf("could not determine busybox dependency versions: %v", err)
+	}
+	upgrades := auditDeps(cmds, bl)
+	var lastCmd string
+	for _, u := range upgrades {
+		if u.Cmd != lastCmd {
+			log.Printf("Dependency versions of %s changed in the busybox:", u.Cmd)
+			lastCmd = u.Cmd
+		}
+		log.Printf("  %s %s => %s", u.Module, u.Version, u.Selected)
+		report.Report(u)
+	}
+	if fatal && len(upgrades) > 0 {
+		return &ErrDependencyUpgrades{Upgrades: upgrades}
+	}
+	return nil
+}
+
 func checkDuplicate(cmds []*bbinternal.Package) error {
 	seen := make(map[string]string)
 	for _, cmd := range cmds {
@@ -83,8 +159,20 @@ type Opts struct {
 
 	// CommandPaths is a list of file system directories containing Go
 	// commands, or Go import paths.
+	//
+	// Both may be `go list`-style patterns such as ./cmds/... or
+	// github.com/u-root/u-root/cmds/core/..., which expand to all
+	// commands they match.
+	//
+	// Import paths and patterns may carry a module version, e.g.
+	// github.com/u-root/u-root/cmds/core/ls@v0.11.0, to fetch the
+	// command through the module proxy instead of a local checkout.
 	CommandPaths []string
 
+	// Excludes are directories, Go import paths or patterns of commands
+	// to leave out of CommandPaths, e.g. ./cmds/exp/....
+	Excludes []string
+
 	// BinaryPath is the file to write the binary to.
 	BinaryPath string
 
@@ -100,6 +188,76 @@ type Opts struct {
 	// Generate the tree but don't build it. This is useful for systems
 	// like Tamago which have their own way of building.
 	GenerateOnly bool
+
+	// Vet reports patterns in commands and their dependencies that are
+	// unsafe to combine into a busybox before rewriting them. See
+	// package bbvet for the list of checks.
+	Vet bool
+
+	// VetFatal fails the build if Vet found any hazards. Implies Vet.
+	VetFatal bool
+
+	// OnDiagnostic, if non-nil, is called with structured diagnostics
+	// about the build, such as commands that were skipped, conflicting
+	// module dependencies, or rewrite failures. See package diag.
+	//
+	// Diagnostics are reported in addition to being logged and, if they
+	// are fatal, returned as errors.
+	OnDiagnostic diag.Handler
+
+	// Strict fails the build if any requested command is skipped, e.g.
+	// because it does not exist, has package errors, or is not `package
+	// main`. The error is an *ErrSkippedCommands listing every skipped
+	// command and why.
+	Strict bool
+
+	// AllowExcluded lists commands, as given in CommandPaths, that may be
+	// skipped in Strict mode when build constraints exclude them for the
+	// target platform.
+	AllowExcluded []string
+
+	// LineDirectives adds //line directives to the generated source, so
+	// that compiler errors, vet output and runtime stack traces refer to
+	// the original command source files instead of generated files.
+	//
+	// The binary will contain the absolute paths of the original source
+	// files, so it is only reproducible across identical checkouts.
+	//
+	// Regardless of this option, build errors are translated using the
+	// source map written to $GenSrcDir/srcmap.json.
+	LineDirectives bool
+
+	// AuditDeps reports, for every command, the dependency modules whose
+	// version in the busybox differs from the version the command's own
+	// go.mod selects.
+	//
+	// Combining commands from several modules runs minimal version
+	// selection over all of their requirements, which may upgrade a
+	// command's dependencies beyond what it was tested with. Only applies
+	// to module builds.
+	AuditDeps bool
+
+	// NoUpgrades fails the build with an *ErrDependencyUpgrades if any
+	// command's dependency versions would change. Implies AuditDeps.
+	NoUpgrades bool
+
+	// LinkerVars are `-ldflags -X` string variable definitions of the form
+	// [cmd:]importpath.name=value, where cmd is a command name or Go
+	// import path.
+	//
+	// Since commands' main packages are rewritten into ordinary packages,
+	// main.name refers to the variable in the rewritten package of cmd,
+	// or of every command if no cmd is given. -X main.name=value in
+	// GoBuildOpts' or Env.GOFLAGS' ldflags is rewritten the same way.
+	LinkerVars []string
+
+	// FS, if non-nil, is the file system the generated source is written
+	// to, at GenSrcDir, instead of disk. With a *genfs.Mem, the whole tree
+	// is generated in memory.
+	//
+	// Compiling, AuditDeps and NoUpgrades need the tree on disk, so FS
+	// requires GenerateOnly and cannot be combined with the other two.
+	FS genfs.FS
 }
 
 // BuildBusybox builds a busybox of many Go commands. opts contains both the
@@ -114,8 +272,22 @@ func BuildBusybox(opts *Opts) (nerr error) {
 		return err
 	}
 
+	if opts.FS != nil && !opts.GenerateOnly {
+		return fmt.Errorf("generating into a file system other than disk requires GenerateOnly")
+	}
+	if opts.FS != nil && (opts.AuditDeps || opts.NoUpgrades) {
+		return fmt.Errorf("AuditDeps and NoUpgrades need the generated source on disk")
+	}
+	fsys := genfs.Default(opts.FS)
+
 	var tmpDir string
-	if opts.GenSrcDir != "" {
+	if opts.FS != nil && opts.GenSrcDir != "" {
+		absDir, err := filepath.Abs(opts.GenSrcDir)
+		if err != nil {
+			return fmt.Errorf("busybox gen src dir %s could not be made absolute: %v", opts.GenSrcDir, err)
+		}
+		tmpDir = absDir
+	} else if opts.GenSrcDir != "" {
 		var relTmpDir string
 		dirents, err := ioutil.ReadDir(opts.GenSrcDir)
 		if os.IsNotExist(err) {
@@ -154,16 +326,30 @@ func BuildBusybox(opts *Opts) (nerr error) {
 	}
 
 	bbDir := filepath.Join(tmpDir, "src/bb.u-root.com/bb")
-	if err := os.MkdirAll(bbDir, 0700); err != nil {
+	if err := fsys.MkdirAll(bbDir, 0700); err != nil {
 		return err
 	}
 	pkgDir := filepath.Join(tmpDir, "src")
 
 	// Ask go about all the commands in one batch for dependency caching.
-	cmds, err := findpkg.NewPackages(opts.Env, opts.CommandPaths...)
+	var skipped []*diag.SkippedCommand
+	cmds, err := findpkg.NewPackages(opts.Env, findpkg.Opts{
+		Report: func(d diag.Diagnostic) {
+			if s, ok := d.(*diag.SkippedCommand); ok {
+				skipped = append(skipped, s)
+			}
+			opts.OnDiagnostic.Report(d)
+		},
+		Excludes: opts.Excludes,
+	}, opts.CommandPaths...)
 	if err != nil {
 		return fmt.Errorf("finding packages failed: %v", err)
 	}
+	if opts.Strict {
+		if err := checkSkipped(skipped, opts.AllowExcluded); err != nil {
+			return err
+		}
+	}
 	if len(cmds) == 0 {
 		return fmt.Errorf("no valid commands given")
 	}
@@ -173,6 +359,23 @@ func BuildBusybox(opts *Opts) (nerr error) {
 		return err
 	}
 
+	if opts.Vet || opts.VetFatal {
+		hazards := bbvet.Check(cmds)
+		for _, h := range hazards {
+			log.Printf("bbvet: %s", h)
+			opts.OnDiagnostic.Report(&diag.VetHazard{
+				Cmd:     h.Cmd,
+				PkgPath: h.PkgPath,
+				Pos:     h.Pos,
+				Check:   string(h.Kind),
+				Message: h.Message,
+			})
+		}
+		if opts.VetFatal && len(hazards) > 0 {
+			return fmt.Errorf("found %d command(s) with patterns unsafe in a busybox", numCmds(hazards))
+		}
+	}
+
 	modules := make(map[string]struct{})
 	var numNoModule int
 	for _, cmd := range cmds {
@@ -186,24 +389,64 @@ func BuildBusybox(opts *Opts) (nerr error) {
 		return fmt.Errorf("busybox does not support mixed module/non-module compilation -- commands contain main modules %v", strings.Join(listStrings(modules), ", "))
 	}
 
+	// Map generated lines back to the original source files for build
+	// errors.
+	srcMap := srcmap.New()
+	out := &bbinternal.Output{
+		SourceMap:      srcMap,
+		LineDirectives: opts.LineDirectives,
+		FS:             opts.FS,
+	}
+
+	// Module builds copy every module's go.mod, so packages keep their
+	// language version. GOPATH builds compile everything with the
+	// toolchain's version, which may change loop variable semantics.
+	if opts.Env.GO111MODULE == "off" || numNoModule > 0 {
+		v, err := opts.Env.Version()
+		if err != nil {
+			return fmt.Errorf("could not determine Go version: %v", err)
+		}
+		out.GoVersion = v
+	}
+
 	// List of packages to import in the real main file.
 	var bbImports []string
 	// Rewrite commands to packages.
 	for _, cmd := range cmds {
 		destination := filepath.Join(pkgDir, cmd.Pkg.PkgPath)
 
-		if err := cmd.Rewrite(destination, "bb.u-root.com/bb/pkg/bbmain"); err != nil {
-			return fmt.Errorf("rewriting command %q failed: %v", cmd.Pkg.PkgPath, err)
+		if err := cmd.Rewrite(destination, "bb.u-root.com/bb/pkg/bbmain", out); err != nil {
+			var rerr *diag.RewriteError
+			if errors.As(err, &rerr) {
+				// It already names the command.
+				opts.OnDiagnostic.Report(rerr)
+				return err
+			}
+			return fmt.Errorf("rewriting command %q failed: %w", cmd.Pkg.PkgPath, err)
 		}
 		bbImports = append(bbImports, cmd.Pkg.PkgPath)
 	}
 
 	// Collect and write dependencies into pkgDir.
-	if err := dealWithDeps(opts.Env, bbDir, tmpDir, pkgDir, cmds); err != nil {
+	if err := dealWithDeps(opts.Env, bbDir, tmpDir, pkgDir, cmds, out, opts.OnDiagnostic); err != nil {
 		return fmt.Errorf("collecting and putting dependencies in place failed: %v", err)
 	}
 
-	if err := writeBBMain(bbDir, tmpDir, bbImports); err != nil {
+	if (opts.AuditDeps || opts.NoUpgrades) && opts.Env.GO111MODULE != "off" && numNoModule == 0 {
+		if err := checkUpgrades(opts.Env, bbDir, cmds, opts.NoUpgrades, opts.OnDiagnostic); err != nil {
+			return err
+		}
+	}
+
+	srcMapJSON, err := srcMap.JSON()
+	if err != nil {
+		return fmt.Errorf("failed to encode source map: %v", err)
+	}
+	if err := fsys.WriteFile(filepath.Join(tmpDir, "srcmap.json"), srcMapJSON, 0644); err != nil {
+		return fmt.Errorf("failed to write source map: %v", err)
+	}
+
+	if err := writeBBMain(fsys, bbDir, bbImports); err != nil {
 		return fmt.Errorf("failed to write main.go: %v", err)
 	}
 
@@ -215,27 +458,72 @@ func BuildBusybox(opts *Opts) (nerr error) {
 	if opts.Env.GO111MODULE == "off" || numNoModule > 0 {
 		opts.Env.GOPATH = tmpDir
 	}
-	if err := opts.Env.BuildDir(bbDir, opts.BinaryPath, opts.GoBuildOpts); err != nil {
+	buildEnv, bopts, err := buildOpts(opts.Env, opts.GoBuildOpts, cmds, opts.LinkerVars)
+	if err != nil {
+		return fmt.Errorf("invalid linker flags: %v", err)
+	}
+	if err := buildEnv.BuildDir(bbDir, opts.BinaryPath, bopts); err != nil {
 		if opts.Env.GO111MODULE == "off" || numNoModule > 0 {
 			return &ErrGopathBuild{
-				CmdDir: bbDir,
-				GOPATH: tmpDir,
-				Err:    err,
+				CmdDir:    bbDir,
+				GOPATH:    tmpDir,
+				Err:       err,
+				SourceMap: srcMap,
 			}
 		} else {
 			return &ErrModuleBuild{
-				CmdDir: bbDir,
-				Err:    err,
+				CmdDir:    bbDir,
+				Err:       err,
+				SourceMap: srcMap,
 			}
 		}
 	}
 	return nil
 }
 
+// ErrSkippedCommands is returned in strict mode if requested commands were
+// skipped.
+type ErrSkippedCommands struct {
+	Skipped []*diag.SkippedCommand
+}
+
+// Error implements error.Error.
+func (e *ErrSkippedCommands) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "strict mode: %d requested command(s) skipped:", len(e.Skipped))
+	for _, s := range e.Skipped {
+		fmt.Fprintf(&b, "\n\t%s: %s", s.Path, s.Reason)
+		if s.Detail != "" {
+			fmt.Fprintf(&b, " (%s)", s.Detail)
+		}
+	}
+	return b.String()
+}
+
+// ErrDependencyUpgrades is returned in NoUpgrades mode if the busybox would
+// use different dependency versions than the commands' own modules.
+type ErrDependencyUpgrades struct {
+	Upgrades []*diag.DependencyUpgrade
+}
+
+// Error implements error.Error.
+func (e *ErrDependencyUpgrades) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "no-upgrades mode: %d dependency version(s) would change:", len(e.Upgrades))
+	for _, u := range e.Upgrades {
+		fmt.Fprintf(&b, "\n\t%s: %s %s => %s", u.Cmd, u.Module, u.Version, u.Selected)
+	}
+	return b.String()
+}
+
 // ErrModuleBuild is returned for a go build failure when modules were enabled.
 type ErrModuleBuild struct {
 	CmdDir string
 	Err    error
+
+	// SourceMap maps generated file positions in Err to the original
+	// command source files.
+	SourceMap *srcmap.Map
 }
 
 // Unwrap implements error.Unwrap.
@@ -245,7 +533,7 @@ func (e *ErrModuleBuild) Unwrap() error {
 
 // Error implements error.Error.
 func (e *ErrModuleBuild) Error() string {
-	return fmt.Sprintf("go build with modules failed: %v", e.Err)
+	return fmt.Sprintf("go build with modules failed: %s", e.SourceMap.Translate(e.CmdDir, e.Err.Error()))
 }
 
 // ErrGopathBuild is returned for a go build failure when modules were disabled.
@@ -253,6 +541,10 @@ type ErrGopathBuild struct {
 	CmdDir string
 	GOPATH string
 	Err    error
+
+	// SourceMap maps generated file positions in Err to the original
+	// command source files.
+	SourceMap *srcmap.Map
 }
 
 // Unwrap implements error.Unwrap.
@@ -262,7 +554,7 @@ func (e *ErrGopathBuild) Unwrap() error {
 
 // Error implements error.Error.
 func (e *ErrGopathBuild) Error() string {
-	return fmt.Sprintf("non-module go build failed: %v", e.Err)
+	return fmt.Sprintf("non-module go build failed: %s", e.SourceMap.Translate(e.CmdDir, e.Err.Error()))
 }
 
 // writeBBMain writes $TMPDIR/src/bb.u-root.com/bb/pkg/bbmain/register.go and
@@ -275,24 +567,20 @@ func (e *ErrGopathBuild) Error() string {
 // problems -- the src/go.mod would conflict with our generated go.mod, and
 // it'd be complicated to merge them. So they are transplanted into the
 // bb.u-root.com/bb module.
-func writeBBMain(bbDir, tmpDir string, bbImports []string) error {
-	if err := os.MkdirAll(filepath.Join(bbDir, "pkg/bbmain"), 0755); err != nil {
+func writeBBMain(fsys genfs.FS, bbDir string, bbImports []string) error {
+	if err := fsys.MkdirAll(filepath.Join(bbDir, "pkg/bbmain"), 0755); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(filepath.Join(bbDir, "pkg/bbmain/register.go"), bbRegisterSource, 0755); err != nil {
-		return err
-	}
-	if err := ioutil.WriteFile(filepath.Join(bbDir, "main.go"), bbMainSource, 0755); err != nil {
+	if err := fsys.WriteFile(filepath.Join(bbDir, "pkg/bbmain/register.go"), bbRegisterSource, 0755); err != nil {
 		return err
 	}
 
-	bbFset, bbFiles, _, err := bbinternal.ParseAST("main", []string{filepath.Join(bbDir, "main.go")})
+	bbFset := token.NewFileSet()
+	bbFile, err := parser.ParseFile(bbFset, filepath.Join(bbDir, "main.go"), bbMainSource, parser.ParseComments)
 	if err != nil {
 		return err
 	}
-	if len(bbFiles) == 0 {
-		return fmt.Errorf("bb package not found")
-	}
+	bbFiles := []*ast.File{bbFile}
 
 	// Fix the import path for bbmain, since we wrote bbmain/register.go into bbDir above.
 	if !astutil.RewriteImport(bbFset, bbFiles[0], "github.com/u-root/gobusybox/src/pkg/bb/bbmain", "bb.u-root.com/bb/pkg/bbmain") {
@@ -300,7 +588,7 @@ func writeBBMain(bbDir, tmpDir string, bbImports []string) error {
 	}
 
 	// Create bb main.go.
-	if err := bbinternal.CreateBBMainSource(bbFset, bbFiles, bbImports, bbDir); err != nil {
+	if err := bbinternal.CreateBBMainSource(bbFset, bbFiles, bbImports, bbDir, fsys); err != nil {
 		return fmt.Errorf("creating bb main.go file failed: %v", err)
 	}
 	return nil
@@ -318,50 +606,54 @@ func isReplacedModuleLocal(m *packages.Module) bool {
 }
 
 // localModules finds all modules that are local, copies their go.mod in the
-// right place, and raises an error if any modules have conflicting replace
-// directives.
-func localModules(pkgDir, bbDir string, mainPkgs []*bbinternal.Package) (map[string]*packages.Module, error) {
+// right place, merges their go.sum into sums, and raises an error if any
+// modules have conflicting replace directives.
+func localModules(fsys genfs.FS, pkgDir string, mainPkgs []*bbinternal.Package, sums *goSum, report diag.Handler) (map[string]*packages.Module, error) {
 	copyGoMod := func(mod *packages.Module) error {
 		if mod == nil {
 			return nil
 		}
 
-		if err := os.MkdirAll(filepath.Join(pkgDir, mod.Path), 0755); os.IsExist(err) {
+		if err := fsys.MkdirAll(filepath.Join(pkgDir, mod.Path), 0755); os.IsExist(err) {
 			return nil
 		} else if err != nil {
 			return err
 		}
 
 		// Use the module file for all outside dependencies.
-		if err := cp.Copy(mod.GoMod, filepath.Join(pkgDir, mod.Path, "go.mod")); err != nil {
+		if err := genfs.CopyFile(fsys, mod.GoMod, filepath.Join(pkgDir, mod.Path, "go.mod")); err != nil {
 			return err
 		}
 
 		// As of Go 1.16, the Go build system expects an accurate
 		// go.sum in the main module directory. We build it by
-		// concatenating all constituent go.sums.
+		// merging all constituent go.sums.
 		//
 		// If it doesn't exist, that's okay!
-		gosum := filepath.Join(filepath.Dir(mod.GoMod), "go.sum")
-		if err := cp.Copy(gosum, filepath.Join(pkgDir, mod.Path, "go.sum")); os.IsNotExist(err) {
+		//
+		// For modules from the module cache (e.g. remote
+		// path@version commands), go.mod is not in the module
+		// directory, but go.sum is.
+		gosumDir := mod.Dir
+		if gosumDir == "" {
+			gosumDir = filepath.Dir(mod.GoMod)
+		}
+		gosum := filepath.Join(gosumDir, "go.sum")
+		if err := genfs.CopyFile(fsys, gosum, filepath.Join(pkgDir, mod.Path, "go.sum")); os.IsNotExist(err) {
 			// Modules without dependencies don't have or need a go.sum.
 			return nil
 		} else if err != nil {
 			return err
 		}
-
-		gosumf, err := os.Open(gosum)
-		if err != nil {
-			return err
-		}
-		defer gosumf.Close()
-		f, err := os.OpenFile(filepath.Join(bbDir, "go.sum"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
-		if err != nil {
+		if err := sums.addFile(gosum); err != nil {
+			var conflict *diag.ChecksumConflict
+			if errors.As(err, &conflict) {
+				report.Report(conflict)
+				return fmt.Errorf("%w; this indicates tampering or a broken module proxy", err)
+			}
 			return err
 		}
-		defer f.Close()
-		_, err = io.Copy(f, gosumf)
-		return err
+		return nil
 	}
 
 	type localModule struct {
@@ -387,13 +679,22 @@ func localModules(pkgDir, bbDir string, mainPkgs []*bbinternal.Package) (map[str
 
 	for _, p := range mainPkgs {
 		replacedModules := locallyReplacedModules(p.Pkg)
-		for modPath, module := range replacedModules {
+		for _, modPath := range modulePaths(replacedModules) {
+			module := replacedModules[modPath]
 			if original, ok := localModules[modPath]; ok {
 				// Is this module different from one that a
 				// previous definition provided?
 				//
 				// This only looks for 2 conflicting *local* module definitions.
 				if original.m.Dir != module.Dir {
+					report.Report(&diag.ModuleConflict{
+						Module: modPath,
+						Uses: []diag.ModuleUse{
+							moduleUse(original.provenance, original.m),
+							moduleUse(fmt.Sprintf("%s's go.mod", p.Pkg.Module.Path), module),
+						},
+						Suggestion: fmt.Sprintf("both go.mod files must replace %s with the same directory", modPath),
+					})
 					return nil, fmt.Errorf("two conflicting versions of module %s have been requested; one from %s, the other from %s's go.mod",
 						modPath, original.provenance, p.Pkg.Module.Path)
 				}
@@ -414,12 +715,20 @@ func localModules(pkgDir, bbDir string, mainPkgs []*bbinternal.Package) (map[str
 	//
 	// E.g. if u-bmc depends on u-root, but we are also compiling u-root locally.
 	var conflict bool
+	// Conflicts are per module, not per package.
+	reported := make(map[[2]string]struct{})
 	for _, mainPkg := range mainPkgs {
 		packages.Visit([]*packages.Package{mainPkg.Pkg}, nil, func(p *packages.Package) {
 			if p.Module == nil {
 				return
 			}
 			if l, ok := localModules[p.Module.Path]; ok && l.m.Dir != p.Module.Dir {
+				key := [2]string{mainPkg.Pkg.Module.Path, p.Module.Path}
+				if _, ok := reported[key]; ok {
+					return
+				}
+				reported[key] = struct{}{}
+
 				fmt.Fprintln(os.Stderr, "")
 				log.Printf("Conflicting module dependencies on %s:", p.Module.Path)
 				log.Printf("  %s uses %s", mainPkg.Pkg.Module.Path, moduleIdentifier(p.Module))
@@ -429,8 +738,17 @@ func localModules(pkgDir, bbDir string, mainPkgs []*bbinternal.Package) (map[str
 					replacePath = l.m.Dir
 				}
 				fmt.Fprintln(os.Stderr, "")
-				log.Printf("%s: add `replace %s => %s` to %s", term.Bold("Suggestion to resolve"), p.Module.Path, replacePath, mainPkg.Pkg.Module.GoMod)
+				suggestion := fmt.Sprintf("add `replace %s => %s` to %s", p.Module.Path, replacePath, mainPkg.Pkg.Module.GoMod)
+				log.Printf("%s: %s", term.Bold("Suggestion to resolve"), suggestion)
 				fmt.Fprintln(os.Stderr, "")
+				report.Report(&diag.ModuleConflict{
+					Module: p.Module.Path,
+					Uses: []diag.ModuleUse{
+						moduleUse(mainPkg.Pkg.Module.Path, p.Module),
+						moduleUse(l.provenance, l.m),
+					},
+					Suggestion: suggestion,
+				})
 				conflict = true
 			}
 		})
@@ -446,6 +764,16 @@ func localModules(pkgDir, bbDir string, mainPkgs []*bbinternal.Package) (map[str
 	return modules, nil
 }
 
+func moduleUse(by string, m *packages.Module) diag.ModuleUse {
+	if m.Replace != nil && isReplacedModuleLocal(m.Replace) {
+		return diag.ModuleUse{By: by, Dir: m.Replace.Path}
+	}
+	if m.Version == "" {
+		return diag.ModuleUse{By: by, Dir: m.Dir}
+	}
+	return diag.ModuleUse{By: by, Version: m.Version}
+}
+
 func moduleIdentifier(m *packages.Module) string {
 	if m.Replace != nil && isReplacedModuleLocal(m.Replace) {
 		return fmt.Sprintf("directory %s", m.Replace.Path)
@@ -456,7 +784,7 @@ func moduleIdentifier(m *packages.Module) string {
 // dealWithDeps tries to suss out local files that need to be in the tree.
 //
 // It helps to have read https://golang.org/ref/mod when editing this function.
-func dealWithDeps(env golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*bbinternal.Package) error {
+func dealWithDeps(env golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*bbinternal.Package, out *bbinternal.Output, report diag.Handler) error {
 	// Module-enabled Go programs resolve their dependencies in one of two ways:
 	//
 	// - locally, if the dependency is *in* the module or there is a local replace directive
@@ -474,7 +802,9 @@ func dealWithDeps(env golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*
 	// Remote dependencies are expected to be resolved from main packages'
 	// go.mod and local dependencies' go.mod files, which all must be in
 	// the tree.
-	localModules, err := localModules(pkgDir, bbDir, mainPkgs)
+	sums := newGoSum()
+	fsys := genfs.Default(out.FS)
+	localModules, err := localModules(fsys, pkgDir, mainPkgs, sums, report)
 	if err != nil {
 		return err
 	}
@@ -505,7 +835,7 @@ func dealWithDeps(env golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*
 	seenIDs := make(map[string]struct{})
 	for _, p := range localDepPkgs {
 		if _, ok := seenIDs[p.ID]; !ok {
-			if err := bbinternal.WritePkg(p, filepath.Join(pkgDir, p.PkgPath)); err != nil {
+			if err := bbinternal.WritePkg(p, filepath.Join(pkgDir, p.PkgPath), out); err != nil {
 				return fmt.Errorf("writing package %s failed: %v", p, err)
 			}
 			seenIDs[p.ID] = struct{}{}
@@ -526,7 +856,12 @@ func dealWithDeps(env golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*
 		var mod modfile.File
 
 		mod.AddModuleStmt("bb.u-root.com/bb")
-		for mpath, module := range localModules {
+		goDirs := make(map[string]goDirectives)
+		// reqs are the requirements of all local modules, which
+		// decide the busybox's dependency versions.
+		var reqs []module.Version
+		for _, mpath := range modulePaths(localModules) {
+			module := localModules[mpath]
 			v := module.Version
 			if len(v) == 0 {
 				// When we don't know the version, we can plug
@@ -556,6 +891,10 @@ func dealWithDeps(env golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*
 				if err != nil {
 					return err
 				}
+				goDirs[mpath] = goDirectivesOf(gomod)
+				for _, r := range gomod.Require {
+					reqs = append(reqs, r.Mod)
+				}
 				for _, r := range gomod.Replace {
 					if strings.HasPrefix(r.New.Path, "./") || strings.HasPrefix(r.New.Path, "../") || strings.HasPrefix(r.New.Path, "/") {
 						continue
@@ -567,6 +906,20 @@ func dealWithDeps(env golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*
 			}
 		}
 
+		// The busybox must use at least the go version of every
+		// module, which may change the behavior of commands from
+		// modules with older versions.
+		merged := mergeGoDirectives(goDirs)
+		if tc := env.Toolchain(); tc != "" && compareGoVersions(tc, merged.Go) > 0 {
+			merged.Toolchain = tc
+		}
+		if merged.Go != "" {
+			warnGoVersionChanges(mainPkgs, goDirs, merged.Go, report)
+		}
+		if err := addGoDirectives(&mod, merged); err != nil {
+			return fmt.Errorf("could not add go directives to go.mod: %v", err)
+		}
+
 		gomod, err := mod.Format()
 		if err != nil {
 			return fmt.Errorf("could not generated go.mod: %v", err)
@@ -576,9 +929,25 @@ func dealWithDeps(env golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*
 		// directives.
 		//
 		// Warn the user if they are potentially incompatible.
-		if err := ioutil.WriteFile(filepath.Join(bbDir, "go.mod"), gomod, 0755); err != nil {
+		if err := fsys.WriteFile(filepath.Join(bbDir, "go.mod"), gomod, 0755); err != nil {
 			return err
 		}
+
+		// Checksums the go command will need, but that no go.sum
+		// has, make `go build` fail. Tell the user which.
+		var cmdPkgs []*packages.Package
+		for _, p := range mainPkgs {
+			cmdPkgs = append(cmdPkgs, p.Pkg)
+		}
+		for _, m := range missingSums(sums, cmdPkgs, localModules, reqs, mod.Replace) {
+			log.Printf("Warning: %v; run `go mod tidy` in the module of %s", m, m.Cmd)
+			report.Report(m)
+		}
+		if len(sums.algos) > 0 {
+			if err := fsys.WriteFile(filepath.Join(bbDir, "go.sum"), sums.format(), 0644); err != nil {
+				return err
+			}
+		}
 		return nil
 	}
 	return nil
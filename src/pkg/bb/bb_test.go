@@ -0,0 +1,61 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+)
+
+func TestCheckSkipped(t *testing.T) {
+	excluded := &diag.SkippedCommand{Path: "/src/cmds/strace", Reason: diag.BuildConstraints}
+	notMain := &diag.SkippedCommand{Path: "example.com/pkg/foo", Reason: diag.NotMain}
+	typo := &diag.SkippedCommand{Path: "example.com/cmds/lss", Reason: diag.PackageErrors, Detail: "no such package"}
+
+	for _, tt := range []struct {
+		name          string
+		skipped       []*diag.SkippedCommand
+		allowExcluded []string
+		want          []*diag.SkippedCommand
+	}{
+		{
+			name: "none skipped",
+		},
+		{
+			name:    "all fail",
+			skipped: []*diag.SkippedCommand{excluded, notMain, typo},
+			want:    []*diag.SkippedCommand{excluded, notMain, typo},
+		},
+		{
+			name:          "allowlisted platform exclusion",
+			skipped:       []*diag.SkippedCommand{excluded, typo},
+			allowExcluded: []string{"/src/cmds/strace"},
+			want:          []*diag.SkippedCommand{typo},
+		},
+		{
+			name:          "allowlist only applies to build constraints",
+			skipped:       []*diag.SkippedCommand{notMain},
+			allowExcluded: []string{"example.com/pkg/foo"},
+			want:          []*diag.SkippedCommand{notMain},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSkipped(tt.skipped, tt.allowExcluded)
+			var got []*diag.SkippedCommand
+			var serr *ErrSkippedCommands
+			if errors.As(err, &serr) {
+				got = serr.Skipped
+			} else if err != nil {
+				t.Fatalf("checkSkipped = %v, want ErrSkippedCommands", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkSkipped = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -30,7 +30,9 @@ import (
 	"golang.org/x/tools/go/packages"
 	"golang.org/x/tools/imports"
 
-	"github.com/u-root/uio/cp"
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+	"github.com/u-root/gobusybox/src/pkg/bb/genfs"
+	"github.com/u-root/gobusybox/src/pkg/bb/srcmap"
 )
 
 // The Go spec defines the following grammar:
@@ -76,16 +78,101 @@ func ParseAST(name string, files []string) (*token.FileSet, []*ast.File, []strin
 // CreateBBMainSource creates a bb Go command main.go that imports all given
 // pkgs and writes the command to destDir.
 //
+// The imports are sorted, so the order of pkgs does not matter.
+//
 // fset and files must be parsed bb template main.go, usually ./bbmain/cmd/main.go.
-func CreateBBMainSource(fset *token.FileSet, files []*ast.File, pkgs []string, destDir string) error {
+//
+// fsys may be nil to write to disk.
+func CreateBBMainSource(fset *token.FileSet, files []*ast.File, pkgs []string, destDir string, fsys genfs.FS) error {
 	if len(files) != 1 {
 		return fmt.Errorf("bb cmd template is supposed to only have one file")
 	}
 
-	for _, pkg := range pkgs {
+	sorted := append([]string(nil), pkgs...)
+	sort.Strings(sorted)
+	for _, pkg := range sorted {
 		astutil.AddNamedImport(fset, files[0], "_", pkg)
 	}
-	return writeFiles(destDir, fset, files)
+	return writeFiles(destDir, fset, files, &Output{FS: fsys})
+}
+
+// AddAliases adds an init function to the bb template main.go file f that
+// registers each alias in aliases (alias -> command name) as another name for
+// its command.
+//
+// f must import bbmain as bbmain. The command packages' init functions, which
+// register the commands, run before it.
+func AddAliases(f *ast.File, aliases map[string]string) error {
+	if len(aliases) == 0 {
+		return nil
+	}
+	var names []string
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+
+	body := &ast.BlockStmt{}
+	for _, alias := range names {
+		name := aliases[alias]
+		if alias == "" || name == "" {
+			return fmt.Errorf("invalid alias %q for command %q", alias, name)
+		}
+		// bbmain.RegisterAlias("alias", "name")
+		body.List = append(body.List, &ast.ExprStmt{X: &ast.CallExpr{
+			Fun: ast.NewIdent("bbmain.RegisterAlias"),
+			Args: []ast.Expr{
+				&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(alias)},
+				&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(name)},
+			},
+		}})
+	}
+	f.Decls = append(f.Decls, &ast.FuncDecl{
+		Name: ast.NewIdent("init"),
+		Type: &ast.FuncType{Params: &ast.FieldList{}},
+		Body: body,
+	})
+	return nil
+}
+
+// Output configures how generated Go files are written.
+//
+// A nil *Output writes files without any of the extras.
+type Output struct {
+	// SourceMap, if non-nil, records which original file and line each
+	// line of the written files came from.
+	SourceMap *srcmap.Map
+
+	// LineDirectives inserts //line directives before each top-level
+	// declaration that came from an original file, so that compiler
+	// errors, vet output and stack traces refer to original files.
+	//
+	// Binaries built from such files embed the absolute paths of the
+	// original source files.
+	LineDirectives bool
+
+	// GoVersion is the Go language version, e.g. go1.22, that written
+	// packages will be compiled with. If empty, every package is compiled
+	// with the version of its own module, whose go.mod is copied along.
+	//
+	// Otherwise, files whose loops behave differently between their
+	// module's version and GoVersion (Go 1.22 made loop variables
+	// per-iteration) get a //go:build go1.N constraint that keeps their
+	// module's language version. Files that need per-iteration loop
+	// variables from a GoVersion older than Go 1.22 are an error.
+	GoVersion string
+
+	// FS is the file system files are written to. If nil, files are
+	// written to disk.
+	FS genfs.FS
+}
+
+// fs returns the file system out writes to.
+func (out *Output) fs() genfs.FS {
+	if out == nil {
+		return genfs.OS{}
+	}
+	return genfs.Default(out.FS)
 }
 
 // Package is a Go package.
@@ -123,6 +210,10 @@ type Package struct {
 	//
 	// The key Expr must also be the AssignStmt.Rhs[0].
 	initAssigns map[ast.Expr]ast.Stmt
+
+	// staticInits are initializer expressions of global variables that
+	// are left in place because they are constant.
+	staticInits map[ast.Expr]struct{}
 }
 
 // NewPackage creates a new Package based on an existing packages.Package.
@@ -132,6 +223,7 @@ func NewPackage(name string, p *packages.Package) *Package {
 		Name:        path.Base(name),
 		Pkg:         p,
 		initAssigns: make(map[ast.Expr]ast.Stmt),
+		staticInits: make(map[ast.Expr]struct{}),
 	}
 
 	pp.mainFuncName = pp.newFunctionName("registeredMain")
@@ -257,6 +349,51 @@ func (p *Package) newImportName(name string, f *ast.File) string {
 	return proposed
 }
 
+// isConstSpec returns whether all of s's names are initialized with constant
+// expressions.
+func (p *Package) isConstSpec(s *ast.ValueSpec) bool {
+	if len(s.Values) != len(s.Names) {
+		return false
+	}
+	for _, v := range s.Values {
+		if tv, ok := p.Pkg.TypesInfo.Types[v]; !ok || tv.Value == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// valueTypes returns the types of the names s declares, as written in
+// Go source, from the types of its initializers.
+//
+// Only Types are used, which all loaders record, not Defs.
+func (p *Package) valueTypes(s *ast.ValueSpec, qualifier types.Qualifier) []string {
+	var typs []string
+	if len(s.Values) == len(s.Names) {
+		for _, v := range s.Values {
+			typs = append(typs, types.TypeString(p.Pkg.TypesInfo.Types[v].Type, qualifier))
+		}
+		return typs
+	}
+	// A multi-value call, or a comma-ok expression, which the type
+	// checker records as a tuple.
+	tuple := p.Pkg.TypesInfo.Types[s.Values[0]].Type.(*types.Tuple)
+	for i := 0; i < tuple.Len(); i++ {
+		typs = append(typs, types.TypeString(tuple.At(i).Type(), qualifier))
+	}
+	return typs
+}
+
+// sameStrings returns whether all of ss are the same.
+func sameStrings(ss []string) bool {
+	for _, s := range ss[1:] {
+		if s != ss[0] {
+			return false
+		}
+	}
+	return true
+}
+
 func (p *Package) rewriteFile(f *ast.File) bool {
 	hasMain := false
 
@@ -330,15 +467,38 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 			if d.Tok != token.VAR {
 				break
 			}
+			var specs []ast.Spec
 			for _, spec := range d.Specs {
 				s := spec.(*ast.ValueSpec)
 				if s.Values == nil {
+					specs = append(specs, s)
+					continue
+				}
+
+				// Constant initializers have no side effects
+				// and may stay where they are. This also keeps
+				// `-ldflags -X` working, which the linker
+				// applies to statically initialized strings.
+				if p.isConstSpec(s) {
+					for _, v := range s.Values {
+						p.staticInits[v] = struct{}{}
+					}
+					specs = append(specs, s)
 					continue
 				}
 
 				// For each assignment, create a new init
-				// function, and place it in the same file.
-				for i, name := range s.Names {
+				// function, and place it in the same file. A
+				// multi-value initializer, as in
+				// `var a, b = f()`, assigns all names at once.
+				for i, v := range s.Values {
+					lhs := []ast.Expr{s.Names[i]}
+					if len(s.Values) != len(s.Names) {
+						lhs = nil
+						for _, name := range s.Names {
+							lhs = append(lhs, name)
+						}
+					}
 					varInit := &ast.FuncDecl{
 						Name: p.nextInit(false),
 						Type: &ast.FuncType{
@@ -348,9 +508,9 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 						Body: &ast.BlockStmt{
 							List: []ast.Stmt{
 								&ast.AssignStmt{
-									Lhs: []ast.Expr{name},
+									Lhs: lhs,
 									Tok: token.ASSIGN,
-									Rhs: []ast.Expr{s.Values[i]},
+									Rhs: []ast.Expr{v},
 								},
 							},
 						},
@@ -359,18 +519,42 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 					// this map, so they can be added to
 					// Init0() in the correct init order
 					// later.
-					p.initAssigns[s.Values[i]] = &ast.ExprStmt{X: &ast.CallExpr{Fun: varInit.Name}}
+					p.initAssigns[v] = &ast.ExprStmt{X: &ast.CallExpr{Fun: varInit.Name}}
 					f.Decls = append(f.Decls, varInit)
 				}
 
 				// Add the type of the expression to the global
-				// declaration instead.
-				if s.Type == nil {
-					typ := p.Pkg.TypesInfo.Types[s.Values[0]]
-					s.Type = ast.NewIdent(types.TypeString(typ.Type, qualifier))
+				// declaration instead. Names of different types
+				// need a declaration each.
+				if s.Type != nil {
+					s.Values = nil
+					specs = append(specs, s)
+					continue
 				}
+				typs := p.valueTypes(s, qualifier)
 				s.Values = nil
+				if sameStrings(typs) {
+					s.Type = ast.NewIdent(typs[0])
+					specs = append(specs, s)
+					continue
+				}
+				for i, name := range s.Names {
+					spec := &ast.ValueSpec{
+						Names: []*ast.Ident{name},
+						Type:  ast.NewIdent(typs[i]),
+					}
+					// Keep the spec's comments on the
+					// first and last declaration.
+					if i == 0 {
+						spec.Doc = s.Doc
+					}
+					if i == len(s.Names)-1 {
+						spec.Comment = s.Comment
+					}
+					specs = append(specs, spec)
+				}
 			}
+			d.Specs = specs
 
 		case *ast.FuncDecl:
 			if d.Recv == nil && d.Name.Name == "main" {
@@ -398,28 +582,71 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 	return hasMain
 }
 
-// WritePkg writes p's files into destDir.
-func WritePkg(p *packages.Package, destDir string) error {
-	if err := os.MkdirAll(destDir, 0755); err != nil {
+// WritePkg writes p's files into destDir, as rendered by RenderPkg.
+//
+// out may be nil.
+func WritePkg(p *packages.Package, destDir string, out *Output) error {
+	files, err := RenderPkg(p, destDir, out)
+	if err != nil {
+		return err
+	}
+	fsys := out.fs()
+	if err := fsys.MkdirAll(destDir, 0755); err != nil {
 		return err
 	}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := fsys.WriteFile(path, files[path].Data, files[path].Perm); err != nil {
+			return fmt.Errorf("error writing %q: %v", path, err)
+		}
+	}
+	return nil
+}
 
+// RenderPkg returns the contents of p's files as they are written into
+// destDir, by path. Go files are formatted and have their lines mapped as
+// configured by out; other files are copied with their permission bits.
+//
+// out may be nil.
+func RenderPkg(p *packages.Package, destDir string, out *Output) (map[string]genfs.File, error) {
+	files := make(map[string]genfs.File)
 	for _, fp := range p.OtherFiles {
-		if err := cp.Copy(fp, filepath.Join(destDir, filepath.Base(fp))); err != nil {
-			return fmt.Errorf("copy failed: %v", err)
+		fi, err := os.Stat(fp)
+		if err != nil {
+			return nil, err
 		}
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Join(destDir, filepath.Base(fp))] = genfs.File{Data: data, Perm: fi.Mode().Perm()}
 	}
 
-	return writeFiles(destDir, p.Fset, p.Syntax)
+	goVersion := moduleGoVersion(p)
+	for _, file := range p.Syntax {
+		path := filepath.Join(destDir, filepath.Base(p.Fset.File(file.Package).Name()))
+		code, err := renderFile(path, p.Fset, file, p.TypesInfo, goVersion, out)
+		if err != nil {
+			return nil, err
+		}
+		files[path] = genfs.File{Data: code, Perm: 0644}
+	}
+	return files, nil
 }
 
-func writeFiles(destDir string, fset *token.FileSet, files []*ast.File) error {
+// writeFiles writes generated files, which need no type information or
+// language version, to destDir.
+func writeFiles(destDir string, fset *token.FileSet, files []*ast.File, out *Output) error {
 	// Write all files out.
 	for _, file := range files {
 		name := fset.File(file.Package).Name()
 
 		path := filepath.Join(destDir, filepath.Base(name))
-		if err := writeFile(path, fset, file); err != nil {
+		if err := writeFile(path, fset, file, out); err != nil {
 			return err
 		}
 	}
@@ -429,10 +656,29 @@ func writeFiles(destDir string, fset *token.FileSet, files []*ast.File) error {
 // Rewrite rewrites p into destDir as a bb package, rewriting its init and main
 // functions.
 //
+// If p includes in-package _test.go files, they are rewritten along with the
+// command's files, and the first of them gets an init function that runs the
+// command's registered init. Tests thereby see the command's package state
+// initialized as it would be in the original command, while a busybox only
+// initializes the command it runs. The first test file also gets a main
+// function that calls the renamed one, for tests that run the command's main.
+//
 // bbImportPath is the importpath to use for bbmain. bbImportPath is usually
 // bb.u-root.com/bb/pkg/bbmain for the Go module/vendor-based compilations, but
 // github.com/u-root/gobusybox/src/pkg/bb/bbmain for bazel-based compilations.
-func (p *Package) Rewrite(destDir, bbImportPath string) error {
+//
+// out may be nil.
+func (p *Package) Rewrite(destDir, bbImportPath string, out *Output) error {
+	if err := p.RewriteSyntax(bbImportPath); err != nil {
+		return err
+	}
+	return WritePkg(p.Pkg, destDir, out)
+}
+
+// RewriteSyntax rewrites p.Pkg.Syntax as Rewrite does, without writing any
+// files. p.Pkg.Syntax can then be written with WritePkg or rendered with
+// RenderPkg.
+func (p *Package) RewriteSyntax(bbImportPath string) error {
 	// This init holds all variable initializations.
 	//
 	// func init0() {}
@@ -452,14 +698,21 @@ func (p *Package) Rewrite(destDir, bbImportPath string) error {
 		}
 	}
 	if mainFile == nil {
-		return fmt.Errorf("no main function found in package %q", p.Pkg.PkgPath)
+		var pos token.Position
+		if len(p.Pkg.Syntax) > 0 {
+			pos = p.Pkg.Fset.Position(p.Pkg.Syntax[0].Package)
+		}
+		return diag.NewRewriteError(p.Pkg.PkgPath, pos, fmt.Errorf("no main function found"))
 	}
 
 	// Add variable initializations to Init0 in the right order.
 	for _, initStmt := range p.Pkg.TypesInfo.InitOrder {
+		if _, ok := p.staticInits[initStmt.Rhs]; ok {
+			continue
+		}
 		a, ok := p.initAssigns[initStmt.Rhs]
 		if !ok {
-			return fmt.Errorf("couldn't find init assignment %s", initStmt)
+			return diag.NewRewriteError(p.Pkg.PkgPath, p.Pkg.Fset.Position(initStmt.Rhs.Pos()), fmt.Errorf("couldn't find init assignment %s", initStmt))
 		}
 		varInit.Body.List = append(varInit.Body.List, a)
 	}
@@ -496,20 +749,294 @@ func (p *Package) Rewrite(destDir, bbImportPath string) error {
 
 	mainFile.Decls = append(mainFile.Decls, varInit, p.init, bbRegisterSelf)
 
-	return WritePkg(p.Pkg, destDir)
+	if testFile := p.firstTestFile(); testFile != nil {
+		// func init() {
+		//   registeredInit()
+		// }
+		//
+		// func main() {
+		//   registeredMain()
+		// }
+		testFile.Decls = append(testFile.Decls, &ast.FuncDecl{
+			Name: ast.NewIdent("init"),
+			Type: &ast.FuncType{},
+			Body: &ast.BlockStmt{
+				List: []ast.Stmt{
+					&ast.ExprStmt{X: &ast.CallExpr{Fun: ast.NewIdent(p.init.Name.Name)}},
+				},
+			},
+		}, &ast.FuncDecl{
+			Name: ast.NewIdent("main"),
+			Type: &ast.FuncType{},
+			Body: &ast.BlockStmt{
+				List: []ast.Stmt{
+					&ast.ExprStmt{X: &ast.CallExpr{Fun: ast.NewIdent(p.mainFuncName)}},
+				},
+			},
+		})
+	}
+	return nil
+}
+
+// InitFuncName is the name of the generated function that runs the command's
+// variable initializations and init functions, which the command registers
+// with bbmain.
+func (p *Package) InitFuncName() string {
+	return p.init.Name.Name
+}
+
+// MainFuncName is the name the command's main function is renamed to, which
+// the command registers with bbmain.
+func (p *Package) MainFuncName() string {
+	return p.mainFuncName
+}
+
+// firstTestFile returns the first _test.go file of p, or nil if p has none.
+func (p *Package) firstTestFile() *ast.File {
+	for _, f := range p.Pkg.Syntax {
+		if strings.HasSuffix(p.Pkg.Fset.File(f.Package).Name(), "_test.go") {
+			return f
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, fset *token.FileSet, f *ast.File, out *Output) error {
+	code, err := renderFile(path, fset, f, nil, "", out)
+	if err != nil {
+		return err
+	}
+	return writeGoFile(out.fs(), path, code)
 }
 
-func writeFile(path string, fset *token.FileSet, f *ast.File) error {
+// renderFile returns the formatted contents of f as written to path.
+func renderFile(path string, fset *token.FileSet, f *ast.File, info *types.Info, goVersion string, out *Output) ([]byte, error) {
 	var buf bytes.Buffer
 	if err := format.Node(&buf, fset, f); err != nil {
-		return fmt.Errorf("error formatting Go file %q: %v", path, err)
+		return nil, fmt.Errorf("error formatting Go file %q: %v", path, err)
+	}
+	code, err := formatGoFile(path, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// inserted are the lines of code added to the file header.
+	var inserted []int
+	if out != nil && out.GoVersion != "" && loopvarChanges(goVersion, out.GoVersion) && hasCapturedLoopVars(f, info) {
+		// A go1.N constraint newer than the toolchain would
+		// silently drop the file instead.
+		if o, _ := langMinor(goVersion); o >= loopvarMinor {
+			return nil, fmt.Errorf("%q relies on Go %s per-iteration loop variables, which toolchain %s does not have; build with a Go 1.%d or newer toolchain", path, goVersion, out.GoVersion, loopvarMinor)
+		}
+		code, inserted, err = addGoVersionConstraint(code, goVersion)
+		if err != nil {
+			return nil, fmt.Errorf("could not keep Go %s loop semantics in %q: %v", goVersion, path, err)
+		}
+	}
+
+	if out != nil && (out.SourceMap != nil || out.LineDirectives) {
+		segments, err := mapLines(fset, f, code, inserted)
+		if err != nil {
+			return nil, fmt.Errorf("could not map lines of %q to original source: %v", path, err)
+		}
+		if out.LineDirectives {
+			code, segments = addLineDirectives(path, code, segments)
+		}
+		if out.SourceMap != nil {
+			out.SourceMap.Add(path, segments)
+		}
 	}
-	return writeGoFile(path, buf.Bytes())
+	return code, nil
 }
 
-func writeGoFile(path string, code []byte) error {
-	// Format the file. Do not fix up imports, as we only moved code around
-	// within files.
+// firstPos returns the index and position of the first identifier in n with a
+// valid position, in ast.Inspect order.
+func firstPos(n ast.Node) (int, token.Pos) {
+	var idx int
+	pos := token.NoPos
+	ast.Inspect(n, func(n ast.Node) bool {
+		if pos.IsValid() {
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok {
+			if id.Pos().IsValid() {
+				pos = id.Pos()
+			} else {
+				idx++
+			}
+		}
+		return true
+	})
+	return idx, pos
+}
+
+// nthIdent returns the position of the idx-th identifier in n, in ast.Inspect
+// order.
+func nthIdent(n ast.Node, idx int) token.Pos {
+	pos := token.NoPos
+	ast.Inspect(n, func(n ast.Node) bool {
+		if pos.IsValid() {
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok {
+			if idx == 0 {
+				pos = id.Pos()
+			}
+			idx--
+		}
+		return true
+	})
+	return pos
+}
+
+func nonImportDecls(f *ast.File) []ast.Decl {
+	var decls []ast.Decl
+	for _, d := range f.Decls {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			continue
+		}
+		decls = append(decls, d)
+	}
+	return decls
+}
+
+// mapLines maps lines of code, the formatted version of f, back to the
+// original source positions recorded in fset.
+//
+// Each top-level declaration starts a new segment. Declarations created by
+// the rewriter are mapped to the first original identifier they contain, if
+// any; otherwise they are marked as generated. inserted are the ascending
+// numbers of lines added to the header of code after formatting, such as
+// build constraints, which are marked as generated as well.
+func mapLines(fset *token.FileSet, f *ast.File, code []byte, inserted []int) ([]srcmap.Segment, error) {
+	genFset := token.NewFileSet()
+	genFile, err := parser.ParseFile(genFset, "", code, 0)
+	if err != nil {
+		return nil, err
+	}
+	origDecls := nonImportDecls(f)
+	genDecls := nonImportDecls(genFile)
+	if len(origDecls) != len(genDecls) {
+		return nil, fmt.Errorf("formatting changed number of declarations from %d to %d", len(origDecls), len(genDecls))
+	}
+
+	// The header comments stay where they were, apart from the inserted
+	// lines. The package clause and the imports after it may not: the
+	// rewriter adds imports.
+	filename := fset.Position(f.Package).Filename
+	segments := []srcmap.Segment{{
+		GenLine: 1,
+		File:    filename,
+		Line:    1,
+	}}
+	addHeader := func(seg srcmap.Segment) {
+		last := &segments[len(segments)-1]
+		if seg.GenLine == last.GenLine {
+			*last = seg
+		} else if seg.File != last.File || (seg.File != "" && seg.Line-last.Line != seg.GenLine-last.GenLine) {
+			segments = append(segments, seg)
+		}
+	}
+	for i, genLine := range inserted {
+		addHeader(srcmap.Segment{GenLine: genLine})
+		// The line after the inserted ones is original again.
+		if i+1 == len(inserted) || inserted[i+1] != genLine+1 {
+			addHeader(srcmap.Segment{
+				GenLine: genLine + 1,
+				File:    filename,
+				Line:    genLine + 1 - (i + 1),
+			})
+		}
+	}
+	addHeader(srcmap.Segment{
+		GenLine: genFset.Position(genFile.Package).Line,
+		File:    filename,
+		Line:    fset.Position(f.Package).Line,
+	})
+	// astutil sets EndPos on the imports it adds, which take the position
+	// of a neighbouring import; the parser never does.
+	origImports := make(map[string]int)
+	for _, imp := range f.Imports {
+		if imp.EndPos == token.NoPos && imp.Path.Pos().IsValid() {
+			origImports[importKey(imp)] = fset.Position(imp.Path.Pos()).Line
+		}
+	}
+	for _, imp := range genFile.Imports {
+		seg := srcmap.Segment{GenLine: genFset.Position(imp.Path.Pos()).Line}
+		if line, ok := origImports[importKey(imp)]; ok {
+			seg.File = filename
+			seg.Line = line
+		}
+		addHeader(seg)
+	}
+
+	for i, orig := range origDecls {
+		declLine := genFset.Position(genDecls[i].Pos()).Line
+		seg := srcmap.Segment{GenLine: declLine}
+
+		if idx, pos := firstPos(orig); pos.IsValid() {
+			origPos := fset.Position(pos)
+			if genPos := nthIdent(genDecls[i], idx); genPos.IsValid() {
+				seg.File = origPos.Filename
+				seg.Line = origPos.Line - (genFset.Position(genPos).Line - declLine)
+				if seg.Line < 1 {
+					seg.Line = 1
+				}
+			}
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// importKey identifies imp within a file.
+func importKey(imp *ast.ImportSpec) string {
+	if imp.Name != nil {
+		return imp.Name.Name + " " + imp.Path.Value
+	}
+	return imp.Path.Value
+}
+
+// addLineDirectives inserts a //line directive before the first line of every
+// segment but the first, and returns the new code and segments adjusted for
+// the inserted lines.
+//
+// Generated segments get a directive pointing back at path itself, so that
+// the positions of subsequent generated code are accurate.
+func addLineDirectives(path string, code []byte, segments []srcmap.Segment) ([]byte, []srcmap.Segment) {
+	lines := bytes.SplitAfter(code, []byte("\n"))
+	var buf bytes.Buffer
+	var newSegments []srcmap.Segment
+	var next, inserted int
+	for i, line := range lines {
+		lineNo := i + 1
+		for next < len(segments) && segments[next].GenLine == lineNo {
+			seg := segments[next]
+			next++
+			if seg.GenLine == 1 {
+				newSegments = append(newSegments, seg)
+				continue
+			}
+			// The directive itself is one line; the segment starts on
+			// the line after it.
+			inserted++
+			outLine := lineNo + inserted
+			if seg.File == "" {
+				fmt.Fprintf(&buf, "//line %s:%d\n", path, outLine)
+			} else {
+				fmt.Fprintf(&buf, "//line %s:%d\n", seg.File, seg.Line)
+			}
+			seg.GenLine = outLine
+			newSegments = append(newSegments, seg)
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes(), newSegments
+}
+
+// formatGoFile formats code. It does not fix up imports, as we only moved code
+// around within files.
+func formatGoFile(path string, code []byte) ([]byte, error) {
 	opts := imports.Options{
 		Comments:   true,
 		TabIndent:  true,
@@ -518,10 +1045,13 @@ func writeGoFile(path string, code []byte) error {
 	}
 	code, err := imports.Process("commandline", code, &opts)
 	if err != nil {
-		return fmt.Errorf("bad parse while processing imports %q: %v", path, err)
+		return nil, fmt.Errorf("bad parse while processing imports %q: %v", path, err)
 	}
+	return code, nil
+}
 
-	if err := ioutil.WriteFile(path, code, 0644); err != nil {
+func writeGoFile(fsys genfs.FS, path string, code []byte) error {
+	if err := fsys.WriteFile(path, code, 0644); err != nil {
 		return fmt.Errorf("error writing Go file to %q: %v", path, err)
 	}
 	return nil
@@ -0,0 +1,51 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbinternal
+
+import (
+	"bytes"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+func TestAddAliases(t *testing.T) {
+	const src = `// Package main is the busybox main.
+package main
+
+import "example.com/bbmain"
+
+func init() {
+	bbmain.Register("bbdiagnose", bbmain.Noop, bbmain.ListCmds)
+}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddAliases(f, map[string]string{"ll": "ls", "[": "test"}); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := format.Node(&b, fset, f); err != nil {
+		t.Fatal(err)
+	}
+	want := src + `func init() {
+	bbmain.RegisterAlias("[", "test")
+	bbmain.RegisterAlias("ll", "ls")
+}
+`
+	if got, err := format.Source(b.Bytes()); err != nil {
+		t.Fatalf("generated source does not parse: %v\n%s", err, b.Bytes())
+	} else if string(got) != want {
+		t.Errorf("AddAliases() =\n%s\nwant\n%s", got, want)
+	}
+
+	if err := AddAliases(f, map[string]string{"": "ls"}); err == nil {
+		t.Errorf("AddAliases(empty alias) = nil, want error")
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbinternal
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/go/packages"
+)
+
+// loopvarMinor is the Go 1.x minor version that made loop variables
+// per-iteration instead of per-loop.
+const loopvarMinor = 22
+
+// langMinor returns N for Go versions 1.N, 1.N.P, go1.N, go1.NrcM, etc.
+func langMinor(v string) (int, bool) {
+	v = strings.TrimPrefix(v, "go")
+	if !strings.HasPrefix(v, "1.") {
+		return 0, false
+	}
+	v = v[len("1."):]
+	end := 0
+	for end < len(v) && v[end] >= '0' && v[end] <= '9' {
+		end++
+	}
+	n, err := strconv.Atoi(v[:end])
+	return n, err == nil
+}
+
+// moduleGoVersion returns the language version p was written for, or "" if
+// unknown.
+//
+// Packages loaded with GO111MODULE=off have no Module. If their files are in a
+// module anyway, that module's go directive is their language version.
+// Otherwise, they were written for GOPATH builds, which compile them with the
+// toolchain's version.
+func moduleGoVersion(p *packages.Package) string {
+	if p.Module == nil {
+		if len(p.GoFiles) == 0 {
+			return ""
+		}
+		return enclosingGoVersion(filepath.Dir(p.GoFiles[0]))
+	}
+	if p.Module.GoVersion == "" {
+		// The go command assumes go 1.16 for modules without a go
+		// directive.
+		return "1.16"
+	}
+	return p.Module.GoVersion
+}
+
+// enclosingGoVersion returns the go directive of the go.mod in dir or its
+// closest parent with one, "1.16" if that go.mod has none, or "" if there is
+// no go.mod.
+func enclosingGoVersion(dir string) string {
+	for {
+		path := filepath.Join(dir, "go.mod")
+		if data, err := ioutil.ReadFile(path); err == nil {
+			f, err := modfile.ParseLax(path, data, nil)
+			if err != nil || f.Go == nil {
+				return "1.16"
+			}
+			return f.Go.Version
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loopvarChanges returns whether loops written for Go language version orig
+// behave differently when compiled as version target.
+func loopvarChanges(orig, target string) bool {
+	o, ok := langMinor(orig)
+	if !ok {
+		return false
+	}
+	t, ok := langMinor(target)
+	if !ok {
+		return false
+	}
+	return (o < loopvarMinor) != (t < loopvarMinor)
+}
+
+// hasCapturedLoopVars returns whether any loop in f declares a variable that
+// is captured by a closure or has its address taken in the loop, i.e. whether
+// f's behavior depends on whether loop variables are per-loop or
+// per-iteration.
+//
+// info is used to find addresses taken implicitly by calling pointer methods
+// on loop variables. It may be nil.
+func hasCapturedLoopVars(f *ast.File, info *types.Info) bool {
+	var found bool
+	ast.Inspect(f, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		var vars []*ast.Ident
+		var body ast.Node
+		switch l := n.(type) {
+		case *ast.RangeStmt:
+			if l.Tok != token.DEFINE {
+				return true
+			}
+			for _, e := range []ast.Expr{l.Key, l.Value} {
+				if id, ok := e.(*ast.Ident); ok && id.Name != "_" {
+					vars = append(vars, id)
+				}
+			}
+			body = l.Body
+		case *ast.ForStmt:
+			a, ok := l.Init.(*ast.AssignStmt)
+			if !ok || a.Tok != token.DEFINE {
+				return true
+			}
+			for _, e := range a.Lhs {
+				if id, ok := e.(*ast.Ident); ok && id.Name != "_" {
+					vars = append(vars, id)
+				}
+			}
+			body = l.Body
+		default:
+			return true
+		}
+		if len(vars) > 0 && capturesAny(body, vars, info) {
+			found = true
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// isVar returns whether id refers to the variable declared by decl.
+func isVar(id, decl *ast.Ident) bool {
+	if id.Name != decl.Name {
+		return false
+	}
+	if id.Obj != nil && decl.Obj != nil {
+		return id.Obj == decl.Obj
+	}
+	return true
+}
+
+// addressedVar returns the variable whose memory x refers to, if x is a
+// variable, a field of it or an element of an array in it.
+func addressedVar(x ast.Expr, info *types.Info) (*ast.Ident, bool) {
+	for {
+		switch e := x.(type) {
+		case *ast.Ident:
+			return e, true
+		case *ast.ParenExpr:
+			x = e.X
+		case *ast.SelectorExpr:
+			sel, ok := info.Selections[e]
+			if !ok || sel.Kind() != types.FieldVal || sel.Indirect() {
+				return nil, false
+			}
+			x = e.X
+		case *ast.IndexExpr:
+			if _, ok := info.TypeOf(e.X).Underlying().(*types.Array); !ok {
+				return nil, false
+			}
+			x = e.X
+		default:
+			return nil, false
+		}
+	}
+}
+
+// takesAddress returns whether the selector e is a method value or call that
+// implicitly takes the address of its operand, i.e. a pointer method selected
+// on an addressable value.
+func takesAddress(e *ast.SelectorExpr, info *types.Info) bool {
+	sel, ok := info.Selections[e]
+	if !ok || sel.Kind() != types.MethodVal || sel.Indirect() {
+		return false
+	}
+	sig, ok := sel.Obj().Type().(*types.Signature)
+	if !ok || sig.Recv() == nil {
+		return false
+	}
+	if _, ok := sig.Recv().Type().(*types.Pointer); !ok {
+		return false
+	}
+	_, ok = sel.Recv().Underlying().(*types.Pointer)
+	return !ok
+}
+
+// capturesAny returns whether n references any of vars from within a
+// function literal, or takes the address of any of them.
+//
+// With info, calling a pointer method on a variable also takes its address.
+func capturesAny(n ast.Node, vars []*ast.Ident, info *types.Info) bool {
+	refers := func(n ast.Node) bool {
+		var ok bool
+		ast.Inspect(n, func(n ast.Node) bool {
+			if id, isID := n.(*ast.Ident); isID {
+				for _, v := range vars {
+					if isVar(id, v) {
+						ok = true
+					}
+				}
+			}
+			return !ok
+		})
+		return ok
+	}
+
+	var found bool
+	ast.Inspect(n, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		switch e := n.(type) {
+		case *ast.FuncLit:
+			if refers(e.Body) {
+				found = true
+			}
+			return false
+		case *ast.UnaryExpr:
+			if e.Op == token.AND && refers(e.X) {
+				found = true
+				return false
+			}
+		case *ast.SelectorExpr:
+			if info == nil || !takesAddress(e, info) {
+				return true
+			}
+			if id, ok := addressedVar(e.X, info); ok && refers(id) {
+				found = true
+				return false
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// plusBuildExpr translates // +build lines into a //go:build expression.
+//
+// Space-separated options are OR'd, comma-separated terms are AND'd, and
+// multiple lines are AND'd.
+func plusBuildExpr(lines []string) string {
+	var ands []string
+	for _, line := range lines {
+		var ors []string
+		for _, opt := range strings.Fields(strings.TrimPrefix(line, "// +build")) {
+			terms := strings.Split(opt, ",")
+			ors = append(ors, strings.Join(terms, " && "))
+		}
+		if len(ors) == 1 {
+			ands = append(ands, ors[0])
+		} else {
+			ands = append(ands, "("+strings.Join(ors, " || ")+")")
+		}
+	}
+	return strings.Join(ands, " && ")
+}
+
+// addGoVersionConstraint adds a go1.N build constraint to the Go file code,
+// which makes the compiler use Go language version 1.N for the file. It
+// returns the new code and the numbers of the lines it inserted, in
+// ascending order.
+//
+// Existing //go:build and // +build constraints are kept.
+func addGoVersionConstraint(code []byte, version string) ([]byte, []int, error) {
+	minor, ok := langMinor(version)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid Go version %q", version)
+	}
+	// Go only honors file versions from go1.21 on, and go1.21 has the
+	// old loop variable semantics as well.
+	if minor < 21 {
+		minor = 21
+	}
+	tag := fmt.Sprintf("go1.%d", minor)
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", code, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := strings.SplitAfter(string(code), "\n")
+	goBuild := -1
+	var plusBuild []int
+	for _, cg := range f.Comments {
+		if cg.Pos() >= f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			line := fset.Position(c.Slash).Line - 1
+			if strings.HasPrefix(c.Text, "//go:build ") {
+				goBuild = line
+			} else if strings.HasPrefix(c.Text, "// +build ") {
+				plusBuild = append(plusBuild, line)
+			}
+		}
+	}
+
+	// before and after are lines to insert around lines[i].
+	before := make(map[int]string)
+	after := make(map[int]string)
+	switch {
+	case goBuild >= 0:
+		expr := strings.TrimSpace(strings.TrimPrefix(lines[goBuild], "//go:build "))
+		lines[goBuild] = fmt.Sprintf("//go:build %s && (%s)\n", tag, expr)
+		if len(plusBuild) > 0 {
+			after[plusBuild[len(plusBuild)-1]] = fmt.Sprintf("// +build %s\n", tag)
+		}
+
+	case len(plusBuild) > 0:
+		var pb []string
+		for _, l := range plusBuild {
+			pb = append(pb, strings.TrimSpace(lines[l]))
+		}
+		after[plusBuild[len(plusBuild)-1]] = fmt.Sprintf("// +build %s\n", tag)
+		before[plusBuild[0]] = fmt.Sprintf("//go:build %s && %s\n", tag, plusBuildExpr(pb))
+
+	default:
+		before[0] = fmt.Sprintf("//go:build %s\n\n", tag)
+	}
+
+	var b strings.Builder
+	var inserted []int
+	lineNo := 1
+	insert := func(s string) {
+		b.WriteString(s)
+		for n := strings.Count(s, "\n"); n > 0; n-- {
+			inserted = append(inserted, lineNo)
+			lineNo++
+		}
+	}
+	for i, line := range lines {
+		insert(before[i])
+		b.WriteString(line)
+		lineNo++
+		insert(after[i])
+	}
+	return []byte(b.String()), inserted, nil
+}
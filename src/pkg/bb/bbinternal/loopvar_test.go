@@ -0,0 +1,301 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbinternal
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/srcmap"
+)
+
+func TestHasCapturedLoopVars(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		body string
+		want bool
+	}{
+		{
+			name: "closure",
+			body: `for _, v := range []int{1, 2} { fns = append(fns, func() int { return v }) }`,
+			want: true,
+		},
+		{
+			name: "address",
+			body: `for i := 0; i < 2; i++ { ptrs = append(ptrs, &i) }`,
+			want: true,
+		},
+		{
+			name: "plain use",
+			body: `for i, v := range []int{1, 2} { println(i, v) }`,
+		},
+		{
+			name: "assigned outside loop",
+			body: `var v int; for _, v = range []int{1, 2} { fns = append(fns, func() int { return v }) }`,
+		},
+		{
+			name: "shadowed in closure",
+			body: `for _, v := range []int{1, 2} { println(v); ifns = append(ifns, func(v int) int { return v }) }`,
+		},
+		{
+			name: "pointer method call",
+			body: `for _, c := range []counter{{}, {}} { c.remember() }`,
+			want: true,
+		},
+		{
+			name: "pointer method on field",
+			body: `for _, h := range []holder{{}} { h.c.remember() }`,
+			want: true,
+		},
+		{
+			name: "pointer method value",
+			body: `for _, c := range []counter{{}} { fns = append(fns, c.remember) }`,
+			want: true,
+		},
+		{
+			name: "value method call",
+			body: `for _, c := range []counter{{}} { c.get() }`,
+		},
+		{
+			name: "pointer method on pointer",
+			body: `for _, c := range []*counter{{}} { c.remember() }`,
+		},
+		{
+			name: "pointer method through pointer field",
+			body: `for _, h := range []holder{{}} { h.p.remember() }`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := `package p
+
+var fns []func() int
+var ifns []func(int) int
+var ptrs []*int
+
+type counter struct{ n int }
+
+func (c *counter) remember() int { ptrs = append(ptrs, &c.n); return 0 }
+func (c counter) get() int { return c.n }
+
+type holder struct {
+	c counter
+	p *counter
+}
+
+func f() {
+` + tt.body + `
+}
+`
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, "p.go", src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := &types.Info{
+				Types:      make(map[ast.Expr]types.TypeAndValue),
+				Selections: make(map[*ast.SelectorExpr]*types.Selection),
+			}
+			if _, err := (&types.Config{}).Check("p", fset, []*ast.File{f}, info); err != nil {
+				t.Fatal(err)
+			}
+			if got := hasCapturedLoopVars(f, info); got != tt.want {
+				t.Errorf("hasCapturedLoopVars() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoopvarChanges(t *testing.T) {
+	for _, tt := range []struct {
+		orig, target string
+		want         bool
+	}{
+		{"1.21", "go1.22.3", true},
+		{"1.16", "go1.21.0", false},
+		{"1.22.0", "go1.23.1", false},
+		{"1.22", "go1.21.5", true},
+		{"", "go1.22", false},
+	} {
+		if got := loopvarChanges(tt.orig, tt.target); got != tt.want {
+			t.Errorf("loopvarChanges(%q, %q) = %t, want %t", tt.orig, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestAddGoVersionConstraint(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		code         string
+		version      string
+		want         string
+		wantInserted []int
+	}{
+		{
+			name:         "no constraint",
+			code:         "// Copyright\n\npackage main\n",
+			version:      "1.18",
+			want:         "//go:build go1.21\n\n// Copyright\n\npackage main\n",
+			wantInserted: []int{1, 2},
+		},
+		{
+			name:         "go:build",
+			code:         "//go:build linux || darwin\n// +build linux darwin\n\npackage main\n",
+			version:      "1.21.0",
+			want:         "//go:build go1.21 && (linux || darwin)\n// +build linux darwin\n// +build go1.21\n\npackage main\n",
+			wantInserted: []int{3},
+		},
+		{
+			name:         "+build only",
+			code:         "// +build linux,amd64 darwin\n// +build !nofoo\n\npackage main\n",
+			version:      "1.22",
+			want:         "//go:build go1.22 && (linux && amd64 || darwin) && !nofoo\n// +build linux,amd64 darwin\n// +build !nofoo\n// +build go1.22\n\npackage main\n",
+			wantInserted: []int{1, 4},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, inserted, err := addGoVersionConstraint([]byte(tt.code), tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("addGoVersionConstraint() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if !reflect.DeepEqual(inserted, tt.wantInserted) {
+				t.Errorf("addGoVersionConstraint() inserted lines %v, want %v", inserted, tt.wantInserted)
+			}
+			// The result must still have valid constraints.
+			if _, err := parser.ParseFile(token.NewFileSet(), "p.go", got, parser.PackageClauseOnly); err != nil {
+				t.Errorf("result does not parse: %v", err)
+			}
+		})
+	}
+}
+
+func TestModuleGoVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbinternal-gover-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for path, content := range map[string]string{
+		"mod/go.mod":          "module example.com/mod\n\ngo 1.21\n",
+		"mod/cmd/main.go":     "package main\n",
+		"gopath/cmd/main.go":  "package main\n",
+		"nogo/go.mod":         "module example.com/nogo\n",
+		"nogo/cmds/a/main.go": "package main\n",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		pkg  *packages.Package
+		want string
+	}{
+		{
+			name: "module",
+			pkg:  &packages.Package{Module: &packages.Module{GoVersion: "1.22"}},
+			want: "1.22",
+		},
+		{
+			name: "module without go directive",
+			pkg:  &packages.Package{Module: &packages.Module{}},
+			want: "1.16",
+		},
+		{
+			name: "GO111MODULE=off in a module",
+			pkg:  &packages.Package{GoFiles: []string{filepath.Join(dir, "mod/cmd/main.go")}},
+			want: "1.21",
+		},
+		{
+			name: "GO111MODULE=off in a module without go directive",
+			pkg:  &packages.Package{GoFiles: []string{filepath.Join(dir, "nogo/cmds/a/main.go")}},
+			want: "1.16",
+		},
+		{
+			name: "GOPATH",
+			pkg:  &packages.Package{GoFiles: []string{filepath.Join(dir, "gopath/cmd/main.go")}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := moduleGoVersion(tt.pkg); got != tt.want {
+				t.Errorf("moduleGoVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderFileOldToolchain(t *testing.T) {
+	src := "package main\n\nvar ptrs []*int\n\nfunc main() {\n\tfor i := 0; i < 2; i++ {\n\t\tptrs = append(ptrs, &i)\n\t}\n}\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A Go 1.21 file keeps its semantics with a go1.21 constraint.
+	code, err := renderFile("/dest/main.go", fset, f, nil, "1.21", &Output{GoVersion: "go1.22.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(code), "//go:build go1.21\n") {
+		t.Errorf("renderFile() =\n%s\nwant go1.21 constraint", code)
+	}
+
+	// A go1.22 constraint would exclude the file from a Go 1.21 build.
+	if _, err := renderFile("/dest/main.go", fset, f, nil, "1.22", &Output{GoVersion: "go1.21.5"}); err == nil {
+		t.Errorf("renderFile(go 1.22 file, go1.21.5 toolchain) = nil, want error")
+	}
+}
+
+func TestRenderFileOldToolchainSourceMap(t *testing.T) {
+	src := "// Copyright\n\n// Command main.\npackage main\n\nvar ptrs []*int\n\nfunc main() {\n\tfor i := 0; i < 2; i++ {\n\t\tptrs = append(ptrs, &i)\n\t}\n}\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "/src/main.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &Output{GoVersion: "go1.22.1", SourceMap: srcmap.New()}
+	code, err := renderFile("/dest/main.go", fset, f, nil, "1.21", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two lines are inserted in front of the header comment.
+	lines := strings.Split(string(code), "\n")
+	for genLine, want := range map[int]int{
+		1:  0,
+		2:  0,
+		3:  1,
+		5:  3,
+		6:  4,
+		12: 10,
+	} {
+		file, line, ok := out.SourceMap.Lookup("/dest/main.go", genLine)
+		if want == 0 {
+			if ok {
+				t.Errorf("Lookup(%d: %q) = %s:%d, want generated", genLine, lines[genLine-1], file, line)
+			}
+		} else if !ok || file != "/src/main.go" || line != want {
+			t.Errorf("Lookup(%d: %q) = %s:%d, %t, want /src/main.go:%d", genLine, lines[genLine-1], file, line, ok, want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbinternal
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/txtar"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/genfs"
+	"github.com/u-root/gobusybox/src/pkg/bb/srcmap"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// wantPrefix is the prefix of golden files in testdata/rewrite archives. All
+// other files are the input module, whose root is the command to rewrite. If
+// the command has _test.go files, they are rewritten with it.
+const wantPrefix = "want/"
+
+// loadCmd loads the command in dir, whose dependencies must all be in the
+// standard library or in dir's module.
+//
+// If tests is true, the command's in-package _test.go files are loaded with
+// it.
+func loadCmd(t *testing.T, dir string, tests bool) *packages.Package {
+	t.Helper()
+	cfg := &packages.Config{
+		Mode:  packages.NeedName | packages.NeedImports | packages.NeedFiles | packages.NeedDeps | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedCompiledGoFiles | packages.NeedModule,
+		Dir:   dir,
+		Env:   append(os.Environ(), "GO111MODULE=on", "GOPROXY=off", "GOFLAGS="),
+		Tests: tests,
+	}
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packages.PrintErrors(pkgs) > 0 {
+		t.Fatalf("command in %s has errors", dir)
+	}
+	if tests {
+		// The in-package test variant has the ID
+		// "<pkg> [<pkg>.test]".
+		for _, p := range pkgs {
+			if p.ID == fmt.Sprintf("%s [%s.test]", p.PkgPath, p.PkgPath) {
+				return p
+			}
+		}
+		t.Fatalf("command in %s has no in-package tests", dir)
+	}
+	if len(pkgs) != 1 {
+		t.Fatalf("loaded %d packages, want 1", len(pkgs))
+	}
+	return pkgs[0]
+}
+
+// writeInput writes the input module of archive a to srcDir and returns
+// whether it has _test.go files.
+func writeInput(t *testing.T, srcDir string, a *txtar.Archive) bool {
+	t.Helper()
+	var hasTests bool
+	for _, f := range a.Files {
+		if strings.HasPrefix(f.Name, wantPrefix) {
+			continue
+		}
+		hasTests = hasTests || strings.HasSuffix(f.Name, "_test.go")
+		path := filepath.Join(srcDir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, f.Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return hasTests
+}
+
+// rewrite rewrites the command in archive a and returns the written files.
+func rewrite(t *testing.T, name string, a *txtar.Archive) map[string][]byte {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bbinternal-rewrite-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	hasTests := writeInput(t, srcDir, a)
+
+	destDir := filepath.Join(dir, "dest")
+	if err := NewPackage(name, loadCmd(t, srcDir, hasTests)).Rewrite(destDir, "bb.u-root.com/bb/pkg/bbmain", nil); err != nil {
+		t.Fatalf("Rewrite() = %v", err)
+	}
+
+	infos, err := ioutil.ReadDir(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(filepath.Join(destDir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[info.Name()] = data
+	}
+	return files
+}
+
+func TestRewrite(t *testing.T) {
+	archives, err := filepath.Glob("testdata/rewrite/*.txtar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range archives {
+		name := strings.TrimSuffix(filepath.Base(path), ".txtar")
+		t.Run(name, func(t *testing.T) {
+			a, err := txtar.ParseFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := rewrite(t, name, a)
+
+			if *update {
+				var files []txtar.File
+				for _, f := range a.Files {
+					if !strings.HasPrefix(f.Name, wantPrefix) {
+						files = append(files, f)
+					}
+				}
+				var names []string
+				for n := range got {
+					names = append(names, n)
+				}
+				sort.Strings(names)
+				for _, n := range names {
+					files = append(files, txtar.File{Name: wantPrefix + n, Data: got[n]})
+				}
+				a.Files = files
+				if err := ioutil.WriteFile(path, txtar.Format(a), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want := make(map[string][]byte)
+			for _, f := range a.Files {
+				if strings.HasPrefix(f.Name, wantPrefix) {
+					want[strings.TrimPrefix(f.Name, wantPrefix)] = f.Data
+				}
+			}
+			for n, data := range got {
+				if w, ok := want[n]; !ok {
+					t.Errorf("unexpected file %s written (run with -update to regenerate golden files)", n)
+				} else if string(w) != string(data) {
+					t.Errorf("%s =\n%s\nwant\n%s", n, data, w)
+				}
+			}
+			for n := range want {
+				if _, ok := got[n]; !ok {
+					t.Errorf("file %s not written", n)
+				}
+			}
+		})
+	}
+}
+
+// TestRewritePositions checks that the source map and //line directives of a
+// command that gains imports point at the original lines.
+func TestRewritePositions(t *testing.T) {
+	a, err := txtar.ParseFile("testdata/rewrite/implicitimport.txtar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "bbinternal-positions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeInput(t, dir, a)
+	orig := filepath.Join(dir, "hello.go")
+
+	var mem genfs.Mem
+	out := &Output{SourceMap: srcmap.New(), LineDirectives: true, FS: &mem}
+	if err := NewPackage("implicitimport", loadCmd(t, dir, false)).Rewrite("/dest", "bb.u-root.com/bb/pkg/bbmain", out); err != nil {
+		t.Fatalf("Rewrite() = %v", err)
+	}
+	code, err := mem.ReadFile("/dest/hello.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "/dest/hello.go", code, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// want is the original line of the first node matching node, or 0
+	// if the node is generated.
+	for _, tt := range []struct {
+		node func(ast.Node) bool
+		desc string
+		want int
+	}{
+		{
+			desc: "import of defaultlog",
+			node: func(n ast.Node) bool {
+				imp, ok := n.(*ast.ImportSpec)
+				return ok && imp.Path.Value == `"example.com/implicitimport/pkg/defaultlog"`
+			},
+			want: 4,
+		},
+		{
+			desc: "added import of log",
+			node: func(n ast.Node) bool {
+				imp, ok := n.(*ast.ImportSpec)
+				return ok && imp.Path.Value == `"log"`
+			},
+		},
+		{
+			desc: "l.Printf in main",
+			node: func(n ast.Node) bool {
+				sel, ok := n.(*ast.SelectorExpr)
+				return ok && sel.Sel.Name == "Printf"
+			},
+			want: 12,
+		},
+	} {
+		var found ast.Node
+		ast.Inspect(f, func(n ast.Node) bool {
+			if found == nil && n != nil && tt.node(n) {
+				found = n
+			}
+			return found == nil
+		})
+		if found == nil {
+			t.Errorf("%s not found in generated code", tt.desc)
+			continue
+		}
+
+		// //line directives are honored by the adjusted position.
+		adjusted := fset.Position(found.Pos())
+		if tt.want != 0 && (adjusted.Filename != orig || adjusted.Line != tt.want) {
+			t.Errorf("//line position of %s = %s, want %s:%d", tt.desc, adjusted, orig, tt.want)
+		}
+		if tt.want == 0 && adjusted.Filename != "/dest/hello.go" {
+			t.Errorf("//line position of %s = %s, want generated file", tt.desc, adjusted)
+		}
+
+		genLine := fset.PositionFor(found.Pos(), false).Line
+		file, line, ok := out.SourceMap.Lookup("/dest/hello.go", genLine)
+		if tt.want != 0 && (!ok || file != orig || line != tt.want) {
+			t.Errorf("source map of %s = %s:%d, %t, want %s:%d", tt.desc, file, line, ok, orig, tt.want)
+		}
+		if tt.want == 0 && ok {
+			t.Errorf("source map of %s = %s:%d, want generated", tt.desc, file, line)
+		}
+	}
+}
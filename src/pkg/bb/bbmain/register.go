@@ -60,12 +60,21 @@ func ListCmds() {
 		}
 		names[n] = &known{bb: n}
 	}
-	// Now walk the array of structs.
-	// We don't sort as we don't want the
-	// footprint of bringing in the package.
-	// If you want it sorted, bb | sort
+	// Now walk the names in sorted order, so the output is the
+	// same every time. We don't use the sort package as we don't
+	// want the footprint of bringing it in.
+	var sorted []string
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && sorted[j] < sorted[j-1]; j-- {
+			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+		}
+	}
 	var hadError bool
-	for c, k := range names {
+	for _, c := range sorted {
+		k := names[c]
 		if len(k.name) == 0 || len(k.bb) == 0 {
 			hadError = true
 			fmt.Printf("%s:\t", c)
@@ -109,6 +118,19 @@ func Register(name string, init, main func()) {
 	}
 }
 
+// RegisterAlias registers alias as another name for the command name, which
+// must already be registered.
+func RegisterAlias(alias, name string) {
+	cmd, ok := bbCmds[name]
+	if !ok {
+		panic(fmt.Sprintf("cannot register alias %q for unknown command %q", alias, name))
+	}
+	if _, ok := bbCmds[alias]; ok {
+		panic(fmt.Sprintf("cannot register alias %q for %q: a command with that name exists", alias, name))
+	}
+	bbCmds[alias] = cmd
+}
+
 // RegisterDefault registers a default init and main function.
 func RegisterDefault(init, main func()) {
 	defaultCmd = &bbCmd{
@@ -0,0 +1,297 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bbvet finds patterns in Go commands that are unsafe to combine into
+// a busybox.
+//
+// Some command patterns break silently in a busybox: all commands share one
+// process-global state (os.Args, flag.CommandLine, http.DefaultServeMux) and
+// every dependency's init function runs for every command. bbvet reports
+// these before commands are rewritten.
+package bbvet
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+)
+
+// Kind is the kind of hazard found.
+type Kind string
+
+// Kinds of hazards bbvet looks for.
+const (
+	// ArgsZero is a read of os.Args[0] to determine behavior.
+	ArgsZero Kind = "args0"
+
+	// DependencyInit is an init function or package-level variable
+	// initializer in a non-standard-library dependency with side effects
+	// on process-global state: registering flags on flag.CommandLine,
+	// reading os.Args, or starting goroutines. It runs for every command
+	// in the busybox. Handlers it registers on http.DefaultServeMux are
+	// reported as GlobalHTTPHandler.
+	//
+	// Only the initialization code itself is checked, not the functions
+	// it calls.
+	DependencyInit Kind = "depinit"
+
+	// FlagParseInInit is a call to flag.Parse in an init function.
+	FlagParseInInit Kind = "flaginit"
+
+	// GlobalHTTPHandler is a handler registered on http.DefaultServeMux
+	// by a command, or by a dependency's initialization code.
+	GlobalHTTPHandler Kind = "httphandler"
+)
+
+// Hazard is a pattern in a command or one of its dependencies that may behave
+// differently once the command is compiled into a busybox.
+type Hazard struct {
+	// Cmd is the name of the command the hazard was found for.
+	Cmd string
+
+	// PkgPath is the import path of the package containing the hazard.
+	// It is either the command itself or one of its dependencies.
+	PkgPath string
+
+	// Pos is the position of the hazard in the original source.
+	Pos token.Position
+
+	// Kind is the kind of hazard.
+	Kind Kind
+
+	// Message describes the hazard.
+	Message string
+}
+
+// String implements fmt.Stringer.
+func (h Hazard) String() string {
+	return fmt.Sprintf("%s: %s: %s [%s]", h.Cmd, h.Pos, h.Message, h.Kind)
+}
+
+// isStdlib is a poor man's standard library test: does the first component of
+// the package path contain a "."?
+func isStdlib(p *packages.Package) bool {
+	if p.Module != nil {
+		return false
+	}
+	firstComp := strings.SplitN(p.PkgPath, "/", 2)
+	return !strings.Contains(firstComp[0], ".")
+}
+
+// Check returns all hazards found in cmds and their non-standard-library
+// dependencies, sorted by command name and position.
+//
+// Checks that need type information are skipped for packages that have none.
+func Check(cmds []*bbinternal.Package) []Hazard {
+	var hazards []Hazard
+	for _, cmd := range cmds {
+		packages.Visit([]*packages.Package{cmd.Pkg}, nil, func(p *packages.Package) {
+			if p != cmd.Pkg && isStdlib(p) {
+				return
+			}
+			hazards = append(hazards, checkPackage(cmd.Name, p, p == cmd.Pkg)...)
+		})
+	}
+	sort.SliceStable(hazards, func(i, j int) bool {
+		a, b := hazards[i], hazards[j]
+		if a.Cmd != b.Cmd {
+			return a.Cmd < b.Cmd
+		}
+		if a.Pos.Filename != b.Pos.Filename {
+			return a.Pos.Filename < b.Pos.Filename
+		}
+		if a.Pos.Line != b.Pos.Line {
+			return a.Pos.Line < b.Pos.Line
+		}
+		return a.Pos.Column < b.Pos.Column
+	})
+	return hazards
+}
+
+// object returns the package-level object e refers to, if any.
+func object(info *types.Info, e ast.Expr) types.Object {
+	if info == nil || info.Uses == nil {
+		return nil
+	}
+	switch x := e.(type) {
+	case *ast.Ident:
+		return info.Uses[x]
+	case *ast.SelectorExpr:
+		return info.Uses[x.Sel]
+	case *ast.ParenExpr:
+		return object(info, x.X)
+	}
+	return nil
+}
+
+// isPkgObject returns true if obj is the object named name in package pkgPath.
+func isPkgObject(obj types.Object, pkgPath, name string) bool {
+	return obj != nil && obj.Pkg() != nil && obj.Pkg().Path() == pkgPath && obj.Name() == name
+}
+
+func isIntConst(info *types.Info, e ast.Expr, want int64) bool {
+	if info != nil && info.Types != nil {
+		if tv, ok := info.Types[e]; ok && tv.Value != nil {
+			v, exact := constant.Int64Val(constant.ToInt(tv.Value))
+			return exact && v == want
+		}
+	}
+	lit, ok := e.(*ast.BasicLit)
+	return ok && lit.Kind == token.INT && lit.Value == fmt.Sprint(want)
+}
+
+// flagRegistrations are the flag package functions that define flags on
+// flag.CommandLine.
+var flagRegistrations = map[string]struct{}{
+	"Bool": {}, "BoolFunc": {}, "BoolVar": {},
+	"Duration": {}, "DurationVar": {},
+	"Float64": {}, "Float64Var": {},
+	"Func": {}, "TextVar": {}, "Var": {},
+	"Int": {}, "Int64": {}, "Int64Var": {}, "IntVar": {},
+	"String": {}, "StringVar": {},
+	"Uint": {}, "Uint64": {}, "Uint64Var": {}, "UintVar": {},
+}
+
+// isHandlerRegistration returns whether call registers a handler on
+// http.DefaultServeMux.
+func isHandlerRegistration(info *types.Info, call *ast.CallExpr) bool {
+	obj := object(info, call.Fun)
+	return isPkgObject(obj, "net/http", "Handle") || isPkgObject(obj, "net/http", "HandleFunc")
+}
+
+// handlerRegistrations returns the calls in n that register handlers on
+// http.DefaultServeMux. Function literals are not looked into, since they
+// need not run during initialization.
+func handlerRegistrations(info *types.Info, n ast.Node) []*ast.CallExpr {
+	var calls []*ast.CallExpr
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.CallExpr:
+			if isHandlerRegistration(info, x) {
+				calls = append(calls, x)
+			}
+		}
+		return true
+	})
+	return calls
+}
+
+// sideEffect returns the first expression or statement in n that changes or
+// depends on process-global state shared by all busybox commands, and
+// describes it. Handler registrations are left to handlerRegistrations.
+// Function literals are not looked into, since they need not run during
+// initialization.
+func sideEffect(info *types.Info, n ast.Node) (ast.Node, string) {
+	var found ast.Node
+	var what string
+	ast.Inspect(n, func(n ast.Node) bool {
+		if found != nil {
+			return false
+		}
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.GoStmt:
+			found, what = x, "starts a goroutine"
+		case *ast.CallExpr:
+			obj := object(info, x.Fun)
+			if obj == nil || obj.Pkg() == nil {
+				break
+			}
+			if _, ok := flagRegistrations[obj.Name()]; ok && obj.Pkg().Path() == "flag" {
+				if _, isFunc := obj.(*types.Func); isFunc && obj.Parent() == obj.Pkg().Scope() {
+					found, what = x, "registers flags on flag.CommandLine"
+				}
+			}
+		case *ast.SelectorExpr:
+			if obj := object(info, x); isPkgObject(obj, "os", "Args") {
+				found, what = x, "reads os.Args"
+			} else if isPkgObject(obj, "flag", "CommandLine") {
+				found, what = x, "uses flag.CommandLine"
+			}
+		}
+		return found == nil
+	})
+	return found, what
+}
+
+func checkPackage(cmdName string, p *packages.Package, isCmd bool) []Hazard {
+	var hazards []Hazard
+	report := func(n ast.Node, kind Kind, format string, args ...interface{}) {
+		hazards = append(hazards, Hazard{
+			Cmd:     cmdName,
+			PkgPath: p.PkgPath,
+			Pos:     p.Fset.Position(n.Pos()),
+			Kind:    kind,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	info := p.TypesInfo
+	reportHandler := func(call *ast.CallExpr) {
+		report(call, GlobalHTTPHandler, "http.%s registers a handler on http.DefaultServeMux, which is shared by all busybox commands", object(info, call.Fun).Name())
+	}
+
+	for _, f := range p.Syntax {
+		for _, decl := range f.Decls {
+			if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.VAR && !isCmd {
+				for _, spec := range gen.Specs {
+					for _, v := range spec.(*ast.ValueSpec).Values {
+						if n, what := sideEffect(info, v); n != nil {
+							report(n, DependencyInit, "variable initialization in dependency %s %s for every busybox command", p.PkgPath, what)
+						}
+						for _, call := range handlerRegistrations(info, v) {
+							reportHandler(call)
+						}
+					}
+				}
+			}
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || fn.Name.Name != "init" || fn.Body == nil {
+				continue
+			}
+			if !isCmd {
+				if n, what := sideEffect(info, fn.Body); n != nil {
+					report(n, DependencyInit, "init function in dependency %s %s for every busybox command, before any command's init", p.PkgPath, what)
+				}
+				for _, call := range handlerRegistrations(info, fn.Body) {
+					reportHandler(call)
+				}
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				if call, ok := n.(*ast.CallExpr); ok && isPkgObject(object(info, call.Fun), "flag", "Parse") {
+					report(call, FlagParseInInit, "flag.Parse called in init; flag.CommandLine is shared by all busybox commands")
+				}
+				return true
+			})
+		}
+
+		// A command's handlers are registered whenever it runs; a
+		// dependency's only count if registered at initialization,
+		// which is checked above.
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.IndexExpr:
+				if isPkgObject(object(info, x.X), "os", "Args") && isIntConst(info, x.Index, 0) {
+					report(x, ArgsZero, "os.Args[0] may be the busybox binary or a symlink to it rather than the command name")
+				}
+			case *ast.CallExpr:
+				if isCmd && isHandlerRegistration(info, x) {
+					reportHandler(x)
+				}
+			}
+			return true
+		})
+	}
+	return hazards
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbvet
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+)
+
+const hazardousCmd = `package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var name = filepath.Base(os.Args[0])
+
+func init() {
+	flag.Parse()
+	http.HandleFunc("/", nil)
+}
+
+func main() {
+	_ = os.Args[1]
+}
+`
+
+const depSrc = `package dep
+
+import (
+	"flag"
+	"net/http"
+	"os"
+)
+
+var verbose = flag.Bool("v", false, "verbose")
+
+var table = map[string]int{}
+
+func init() {
+	table["a"] = 1
+}
+
+func init() {
+	if len(os.Args) > 1 {
+		go func() {}()
+	}
+}
+
+func init() {
+	http.HandleFunc("/debug", nil)
+}
+
+func Serve() {
+	http.Handle("/", nil)
+}
+`
+
+func loadPkg(t *testing.T, fset *token.FileSet, pkgPath, filename, src string) *packages.Package {
+	t.Helper()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	tpkg, err := conf.Check(pkgPath, fset, []*ast.File{f}, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &packages.Package{
+		Name:      tpkg.Name(),
+		PkgPath:   pkgPath,
+		Fset:      fset,
+		Syntax:    []*ast.File{f},
+		Types:     tpkg,
+		TypesInfo: info,
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fset := token.NewFileSet()
+	cmd := loadPkg(t, fset, "example.com/cmd/foo", "/cmd/foo/main.go", hazardousCmd)
+	dep := loadPkg(t, fset, "example.com/pkg/dep", "/pkg/dep/dep.go", depSrc)
+	dep.Module = &packages.Module{Path: "example.com"}
+	cmd.Imports = map[string]*packages.Package{dep.PkgPath: dep}
+
+	hazards := Check([]*bbinternal.Package{{Name: "foo", Pkg: cmd}})
+
+	type want struct {
+		file string
+		line int
+		kind Kind
+	}
+	wants := []want{
+		{"/cmd/foo/main.go", 10, ArgsZero},
+		{"/cmd/foo/main.go", 13, FlagParseInInit},
+		{"/cmd/foo/main.go", 14, GlobalHTTPHandler},
+		// The init that only fills a package-level map is not
+		// reported.
+		{"/pkg/dep/dep.go", 9, DependencyInit},
+		{"/pkg/dep/dep.go", 18, DependencyInit},
+		// A handler registered at init is reported once; one
+		// registered by a function that may never run is not.
+		{"/pkg/dep/dep.go", 24, GlobalHTTPHandler},
+	}
+	if len(hazards) != len(wants) {
+		t.Fatalf("Check() = %v, want %d hazards", hazards, len(wants))
+	}
+	for i, w := range wants {
+		h := hazards[i]
+		if h.Cmd != "foo" || h.Pos.Filename != w.file || h.Pos.Line != w.line || h.Kind != w.kind {
+			t.Errorf("hazard %d = %v, want %s:%d [%s]", i, h, w.file, w.line, w.kind)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package diag defines structured diagnostics for busybox builds.
+//
+// Besides returning an error, bb.BuildBusybox reports what it skipped or
+// failed on as typed diagnostics, so that callers such as CI systems can act
+// on them without parsing log output.
+package diag
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+)
+
+// Diagnostic is a problem found while building a busybox.
+//
+// Diagnostics are errors so that they can be wrapped into the error returned
+// by a build and retrieved with errors.As.
+type Diagnostic interface {
+	error
+
+	// Kind is a stable, machine-readable name for the kind of diagnostic.
+	Kind() string
+}
+
+// Handler is called for every diagnostic found.
+type Handler func(Diagnostic)
+
+// Report calls h with d if h is non-nil.
+func (h Handler) Report(d Diagnostic) {
+	if h != nil {
+		h(d)
+	}
+}
+
+// List collects diagnostics.
+type List []Diagnostic
+
+// Add appends d to l. It can be used as a Handler.
+func (l *List) Add(d Diagnostic) {
+	*l = append(*l, d)
+}
+
+// Reason is why a command was skipped.
+type Reason string
+
+// Reasons for skipping commands.
+const (
+	// PackageErrors means the package could not be loaded.
+	PackageErrors Reason = "package-errors"
+
+	// NoGoFiles means the package has no Go files.
+	NoGoFiles Reason = "no-go-files"
+
+	// NotMain means the package is not `package main`.
+	NotMain Reason = "not-main"
+
+	// BuildConstraints means build constraints exclude all Go files
+	// for the target platform.
+	BuildConstraints Reason = "build-constraints"
+)
+
+// SkippedCommand is a requested command that is not part of the busybox.
+type SkippedCommand struct {
+	// Path is the Go import path or directory of the command.
+	Path string `json:"path"`
+
+	// Reason is why it was skipped.
+	Reason Reason `json:"reason"`
+
+	// Detail is a human-readable explanation, e.g. package errors.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Kind implements Diagnostic.
+func (*SkippedCommand) Kind() string { return "skipped-command" }
+
+// Error implements error.
+func (s *SkippedCommand) Error() string {
+	if s.Detail != "" {
+		return fmt.Sprintf("skipped command %s (%s): %s", s.Path, s.Reason, s.Detail)
+	}
+	return fmt.Sprintf("skipped command %s (%s)", s.Path, s.Reason)
+}
+
+// ModuleUse is one use of a module by a command or module.
+type ModuleUse struct {
+	// By describes who uses the module, e.g. a module path or the
+	// user's request to compile a module.
+	By string `json:"by"`
+
+	// Version is the module version used, if it is a remote module.
+	Version string `json:"version,omitempty"`
+
+	// Dir is the module directory, if it is a local module.
+	Dir string `json:"dir,omitempty"`
+}
+
+func (u ModuleUse) String() string {
+	if u.Dir != "" {
+		return fmt.Sprintf("%s uses directory %s", u.By, u.Dir)
+	}
+	return fmt.Sprintf("%s uses version %s", u.By, u.Version)
+}
+
+// ModuleConflict is a module that commands depend on in incompatible ways.
+type ModuleConflict struct {
+	// Module is the conflicting module path.
+	Module string `json:"module"`
+
+	// Uses are the conflicting uses of Module.
+	Uses []ModuleUse `json:"uses"`
+
+	// Suggestion is a human-readable suggestion to resolve the conflict.
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// Kind implements Diagnostic.
+func (*ModuleConflict) Kind() string { return "module-conflict" }
+
+// Error implements error.
+func (m *ModuleConflict) Error() string {
+	var uses []string
+	for _, u := range m.Uses {
+		uses = append(uses, u.String())
+	}
+	return fmt.Sprintf("conflicting module dependencies on %s: %s", m.Module, strings.Join(uses, "; "))
+}
+
+// RewriteError is a failure to rewrite a command into a busybox package.
+type RewriteError struct {
+	// PkgPath is the Go import path of the command.
+	PkgPath string `json:"pkg_path"`
+
+	// Pos is the position in the original source the error refers to. It
+	// may be invalid if no specific position is at fault.
+	Pos token.Position `json:"pos"`
+
+	// Err is the underlying error.
+	Err error `json:"-"`
+
+	// Message is Err's message, for JSON output.
+	Message string `json:"message"`
+}
+
+// NewRewriteError returns a RewriteError for the command pkgPath. err should
+// not repeat pkgPath or pos, which the RewriteError's message adds.
+func NewRewriteError(pkgPath string, pos token.Position, err error) *RewriteError {
+	return &RewriteError{
+		PkgPath: pkgPath,
+		Pos:     pos,
+		Err:     err,
+		Message: err.Error(),
+	}
+}
+
+// Kind implements Diagnostic.
+func (*RewriteError) Kind() string { return "rewrite-error" }
+
+// Error implements error.
+func (r *RewriteError) Error() string {
+	if r.Pos.IsValid() {
+		return fmt.Sprintf("rewriting command %s failed at %s: %v", r.PkgPath, r.Pos, r.Err)
+	}
+	return fmt.Sprintf("rewriting command %s failed: %v", r.PkgPath, r.Err)
+}
+
+// Unwrap implements errors.Unwrap.
+func (r *RewriteError) Unwrap() error {
+	return r.Err
+}
+
+// DependencyUpgrade is a dependency module whose version in the busybox
+// differs from the version the command's own module selects.
+//
+// Combining commands from different modules runs minimal version selection
+// over all of their requirements, so a command may be linked against a newer
+// dependency version than it was tested with.
+type DependencyUpgrade struct {
+	// Cmd is the Go import path of the command.
+	Cmd string `json:"cmd"`
+
+	// Module is the dependency module path.
+	Module string `json:"module"`
+
+	// Version is the version selected by the command's own module.
+	Version string `json:"version"`
+
+	// Selected is the version selected for the busybox.
+	Selected string `json:"selected"`
+}
+
+// Kind implements Diagnostic.
+func (*DependencyUpgrade) Kind() string { return "dependency-upgrade" }
+
+// Error implements error.
+func (d *DependencyUpgrade) Error() string {
+	return fmt.Sprintf("command %s uses %s %s in the busybox instead of %s", d.Cmd, d.Module, d.Selected, d.Version)
+}
+
+// Checksum is a go.sum hash and the go.sum file it came from.
+type Checksum struct {
+	// Hash is the go.sum hash, e.g. h1:...
+	Hash string `json:"hash"`
+
+	// File is the go.sum file the hash was read from.
+	File string `json:"file"`
+}
+
+// ChecksumConflict is a module version for which go.sum files of the combined
+// modules disagree on the checksum.
+//
+// This indicates tampering or a broken module proxy, and is always fatal.
+type ChecksumConflict struct {
+	// Module is the module path.
+	Module string `json:"module"`
+
+	// Version is the module version, with a /go.mod suffix if the
+	// checksum is of the module's go.mod file only.
+	Version string `json:"version"`
+
+	// Sums are the conflicting checksums.
+	Sums []Checksum `json:"sums"`
+}
+
+// Kind implements Diagnostic.
+func (*ChecksumConflict) Kind() string { return "checksum-conflict" }
+
+// Error implements error.
+func (c *ChecksumConflict) Error() string {
+	var sums []string
+	for _, s := range c.Sums {
+		sums = append(sums, fmt.Sprintf("%s in %s", s.Hash, s.File))
+	}
+	return fmt.Sprintf("conflicting go.sum checksums for %s %s: %s", c.Module, c.Version, strings.Join(sums, "; "))
+}
+
+// MissingChecksum is a module version that a command needs, but that no
+// go.sum file of the combined modules has a checksum for.
+//
+// The go command refuses to build without it.
+type MissingChecksum struct {
+	// Module is the module path.
+	Module string `json:"module"`
+
+	// Version is the module version, with a /go.mod suffix if the
+	// checksum is of the module's go.mod file only.
+	Version string `json:"version"`
+
+	// Cmd is the Go import path of a command that needs the module.
+	Cmd string `json:"cmd"`
+}
+
+// Kind implements Diagnostic.
+func (*MissingChecksum) Kind() string { return "missing-checksum" }
+
+// Error implements error.
+func (m *MissingChecksum) Error() string {
+	return fmt.Sprintf("missing go.sum checksum for %s %s (needed by %s)", m.Module, m.Version, m.Cmd)
+}
+
+// GoVersionChange is a module of commands whose go.mod declares an older go
+// version than the busybox uses, where the difference changes the commands'
+// behavior.
+type GoVersionChange struct {
+	// Module is the module path.
+	Module string `json:"module"`
+
+	// Version is the go version the module declares.
+	Version string `json:"version"`
+
+	// Selected is the go version of the busybox.
+	Selected string `json:"selected"`
+
+	// Cmds are the Go import paths of the affected commands.
+	Cmds []string `json:"cmds"`
+
+	// Changes describe the behavior changes.
+	Changes []string `json:"changes"`
+}
+
+// Kind implements Diagnostic.
+func (*GoVersionChange) Kind() string { return "go-version-change" }
+
+// Error implements error.
+func (g *GoVersionChange) Error() string {
+	return fmt.Sprintf("module %s declares go %s, but the busybox uses go %s: %s", g.Module, g.Version, g.Selected, strings.Join(g.Changes, "; "))
+}
+
+// VetHazard is a pattern in a command or one of its dependencies that may
+// behave differently once the command is compiled into a busybox. See package
+// bbvet.
+type VetHazard struct {
+	// Cmd is the name of the command the hazard was found for.
+	Cmd string `json:"cmd"`
+
+	// PkgPath is the import path of the package containing the hazard.
+	PkgPath string `json:"pkg_path"`
+
+	// Pos is the position of the hazard in the original source.
+	Pos token.Position `json:"pos"`
+
+	// Check is the bbvet check that found the hazard, e.g. args0.
+	Check string `json:"check"`
+
+	// Message describes the hazard.
+	Message string `json:"message"`
+}
+
+// Kind implements Diagnostic.
+func (*VetHazard) Kind() string { return "vet-hazard" }
+
+// Error implements error.
+func (v *VetHazard) Error() string {
+	return fmt.Sprintf("%s: %s: %s [%s]", v.Cmd, v.Pos, v.Message, v.Check)
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	pos := token.Position{Filename: "/src/cmds/ls/ls.go", Line: 3, Column: 1}
+	for _, tt := range []struct {
+		d        Diagnostic
+		kind     string
+		err      string
+		jsonWant string
+	}{
+		{
+			d:        &SkippedCommand{Path: "example.com/cmds/lss", Reason: PackageErrors, Detail: "no such package"},
+			kind:     "skipped-command",
+			err:      "skipped command example.com/cmds/lss (package-errors): no such package",
+			jsonWant: `{"path":"example.com/cmds/lss","reason":"package-errors","detail":"no such package"}`,
+		},
+		{
+			d:        &SkippedCommand{Path: "/src/cmds/strace", Reason: BuildConstraints},
+			kind:     "skipped-command",
+			err:      "skipped command /src/cmds/strace (build-constraints)",
+			jsonWant: `{"path":"/src/cmds/strace","reason":"build-constraints"}`,
+		},
+		{
+			d: &ModuleConflict{
+				Module: "example.com/dep",
+				Uses: []ModuleUse{
+					{By: "example.com/a", Version: "v1.0.0"},
+					{By: "example.com/b", Dir: "/src/dep"},
+				},
+			},
+			kind:     "module-conflict",
+			err:      "conflicting module dependencies on example.com/dep: example.com/a uses version v1.0.0; example.com/b uses directory /src/dep",
+			jsonWant: `{"module":"example.com/dep","uses":[{"by":"example.com/a","version":"v1.0.0"},{"by":"example.com/b","dir":"/src/dep"}]}`,
+		},
+		{
+			d:        NewRewriteError("example.com/cmds/ls", pos, fmt.Errorf("no main function found")),
+			kind:     "rewrite-error",
+			err:      "rewriting command example.com/cmds/ls failed at /src/cmds/ls/ls.go:3:1: no main function found",
+			jsonWant: `{"pkg_path":"example.com/cmds/ls","pos":{"Filename":"/src/cmds/ls/ls.go","Offset":0,"Line":3,"Column":1},"message":"no main function found"}`,
+		},
+		{
+			d:        NewRewriteError("example.com/cmds/ls", token.Position{}, fmt.Errorf("no main function found")),
+			kind:     "rewrite-error",
+			err:      "rewriting command example.com/cmds/ls failed: no main function found",
+			jsonWant: `{"pkg_path":"example.com/cmds/ls","pos":{"Filename":"","Offset":0,"Line":0,"Column":0},"message":"no main function found"}`,
+		},
+		{
+			d:        &DependencyUpgrade{Cmd: "example.com/cmds/ls", Module: "example.com/dep", Version: "v1.0.0", Selected: "v1.1.0"},
+			kind:     "dependency-upgrade",
+			err:      "command example.com/cmds/ls uses example.com/dep v1.1.0 in the busybox instead of v1.0.0",
+			jsonWant: `{"cmd":"example.com/cmds/ls","module":"example.com/dep","version":"v1.0.0","selected":"v1.1.0"}`,
+		},
+		{
+			d: &ChecksumConflict{
+				Module:  "example.com/dep",
+				Version: "v1.0.0/go.mod",
+				Sums:    []Checksum{{Hash: "h1:a=", File: "a/go.sum"}, {Hash: "h1:b=", File: "b/go.sum"}},
+			},
+			kind:     "checksum-conflict",
+			err:      "conflicting go.sum checksums for example.com/dep v1.0.0/go.mod: h1:a= in a/go.sum; h1:b= in b/go.sum",
+			jsonWant: `{"module":"example.com/dep","version":"v1.0.0/go.mod","sums":[{"hash":"h1:a=","file":"a/go.sum"},{"hash":"h1:b=","file":"b/go.sum"}]}`,
+		},
+		{
+			d:        &MissingChecksum{Module: "example.com/dep", Version: "v1.1.0", Cmd: "example.com/cmds/ls"},
+			kind:     "missing-checksum",
+			err:      "missing go.sum checksum for example.com/dep v1.1.0 (needed by example.com/cmds/ls)",
+			jsonWant: `{"module":"example.com/dep","version":"v1.1.0","cmd":"example.com/cmds/ls"}`,
+		},
+		{
+			d: &GoVersionChange{
+				Module:   "example.com",
+				Version:  "1.21",
+				Selected: "1.22",
+				Cmds:     []string{"example.com/cmds/ls"},
+				Changes:  []string{"loop variables are per-iteration"},
+			},
+			kind:     "go-version-change",
+			err:      "module example.com declares go 1.21, but the busybox uses go 1.22: loop variables are per-iteration",
+			jsonWant: `{"module":"example.com","version":"1.21","selected":"1.22","cmds":["example.com/cmds/ls"],"changes":["loop variables are per-iteration"]}`,
+		},
+		{
+			d:        &VetHazard{Cmd: "ls", PkgPath: "example.com/cmds/ls", Pos: pos, Check: "args0", Message: "os.Args[0] read"},
+			kind:     "vet-hazard",
+			err:      "ls: /src/cmds/ls/ls.go:3:1: os.Args[0] read [args0]",
+			jsonWant: `{"cmd":"ls","pkg_path":"example.com/cmds/ls","pos":{"Filename":"/src/cmds/ls/ls.go","Offset":0,"Line":3,"Column":1},"check":"args0","message":"os.Args[0] read"}`,
+		},
+	} {
+		if got := tt.d.Kind(); got != tt.kind {
+			t.Errorf("%T.Kind() = %q, want %q", tt.d, got, tt.kind)
+		}
+		if got := tt.d.Error(); got != tt.err {
+			t.Errorf("%T.Error() =\n%s\nwant\n%s", tt.d, got, tt.err)
+		}
+		b, err := json.Marshal(tt.d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.jsonWant {
+			t.Errorf("json.Marshal(%T) =\n%s\nwant\n%s", tt.d, b, tt.jsonWant)
+		}
+	}
+}
+
+func TestRewriteErrorUnwrap(t *testing.T) {
+	cause := errors.New("cause")
+	err := fmt.Errorf("build: %w", NewRewriteError("example.com/cmds/ls", token.Position{}, cause))
+	var rerr *RewriteError
+	if !errors.As(err, &rerr) || rerr.PkgPath != "example.com/cmds/ls" {
+		t.Errorf("errors.As(%v, *RewriteError) = %v, want the RewriteError", err, rerr)
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("errors.Is(%v, cause) = false, want true", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	// A nil Handler drops diagnostics.
+	var h Handler
+	h.Report(&SkippedCommand{Path: "a"})
+
+	var l List
+	h = l.Add
+	h.Report(&SkippedCommand{Path: "a"})
+	h.Report(&MissingChecksum{Module: "b"})
+	if len(l) != 2 || l[0].Kind() != "skipped-command" || l[1].Kind() != "missing-checksum" {
+		t.Errorf("List = %v, want the 2 reported diagnostics", l)
+	}
+}
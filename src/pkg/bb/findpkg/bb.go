@@ -13,12 +13,14 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"golang.org/x/sys/unix"
 	"golang.org/x/tools/go/packages"
 
 	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
 	"github.com/u-root/gobusybox/src/pkg/golang"
 )
 
@@ -60,7 +62,7 @@ func modules(filesystemPaths []string) (map[string][]string, []string) {
 //
 // Namely, PWD determines which go.mod to use. We want each
 // package to use its own go.mod, if it has one.
-func loadFSPackages(env golang.Environ, filesystemPaths []string) ([]*packages.Package, error) {
+func loadFSPackages(env golang.Environ, report diag.Handler, filesystemPaths []string) ([]*packages.Package, error) {
 	var absPaths []string
 	for _, fsPath := range filesystemPaths {
 		absPath, err := filepath.Abs(fsPath)
@@ -80,62 +82,134 @@ func loadFSPackages(env golang.Environ, filesystemPaths []string) ([]*packages.P
 	// several minutes for 30+ commands.
 	mods, noModulePkgDirs := modules(absPaths)
 
-	for moduleDir, pkgDirs := range mods {
-		pkgs, err := loadFSPkgs(env, moduleDir, pkgDirs...)
+	// Load modules in a stable order, so that commands are found and
+	// diagnostics are reported in the same order every time.
+	var moduleDirs []string
+	for moduleDir := range mods {
+		moduleDirs = append(moduleDirs, moduleDir)
+	}
+	sort.Strings(moduleDirs)
+	for _, moduleDir := range moduleDirs {
+		pkgs, err := loadFSPkgs(env, report, moduleDir, mods[moduleDir]...)
 		if err != nil {
 			return nil, fmt.Errorf("could not find packages in module %s: %v", moduleDir, err)
 		}
 		for _, pkg := range pkgs {
-			allps = addPkg(allps, pkg)
+			allps = addPkg(report, allps, pkg)
 		}
 	}
 
 	if len(noModulePkgDirs) > 0 {
 		// The directory we choose can be any dir that does not have a
 		// go.mod anywhere in its parent tree.
-		vendoredPkgs, err := loadFSPkgs(env, noModulePkgDirs[0], noModulePkgDirs...)
+		vendoredPkgs, err := loadFSPkgs(env, report, noModulePkgDirs[0], noModulePkgDirs...)
 		if err != nil {
 			return nil, fmt.Errorf("could not find packages: %v", err)
 		}
 		for _, p := range vendoredPkgs {
-			allps = addPkg(allps, p)
+			allps = addPkg(report, allps, p)
 		}
 	}
 	return allps, nil
 }
 
-func addPkg(plist []*packages.Package, p *packages.Package) []*packages.Package {
+// addPkg adds p to plist if it is a command, and otherwise logs and reports
+// why it was skipped.
+func addPkg(report diag.Handler, plist []*packages.Package, p *packages.Package) []*packages.Package {
 	if len(p.Errors) > 0 {
 		// TODO(chrisko): should we return an error here instead of warn?
 		log.Printf("Skipping package %v for errors:", p)
 		packages.PrintErrors([]*packages.Package{p})
+
+		var errs []string
+		reason := diag.BuildConstraints
+		for _, err := range p.Errors {
+			errs = append(errs, err.Error())
+			// Import paths excluded by build constraints are
+			// reported by go list as package errors.
+			if !strings.Contains(err.Msg, "build constraints exclude all Go files") {
+				reason = diag.PackageErrors
+			}
+		}
+		report.Report(&diag.SkippedCommand{
+			Path:   p.ID,
+			Reason: reason,
+			Detail: strings.Join(errs, "; "),
+		})
 	} else if len(p.GoFiles) == 0 {
 		log.Printf("Skipping package %v because it has no Go files", p)
+		report.Report(&diag.SkippedCommand{Path: p.ID, Reason: diag.NoGoFiles})
 	} else if p.Name != "main" {
 		log.Printf("Skipping package %v because it is not a command (must be `package main`)", p)
+		report.Report(&diag.SkippedCommand{Path: p.ID, Reason: diag.NotMain})
 	} else {
 		plist = append(plist, p)
 	}
 	return plist
 }
 
+// Opts are optional arguments to NewPackages.
+type Opts struct {
+	// Report, if non-nil, is called with a *diag.SkippedCommand for every
+	// named package that is not a command.
+	Report diag.Handler
+
+	// Excludes are directory paths, Go import paths or patterns of
+	// commands to leave out, e.g. ./cmds/exp/....
+	Excludes []string
+}
+
 // NewPackages collects package metadata about all named packages.
 //
-// names can either be directory paths or Go import paths.
-func NewPackages(env golang.Environ, names ...string) ([]*bbinternal.Package, error) {
+// names can either be directory paths or Go import paths. Both may be `go
+// list`-style patterns, e.g. ./cmds/... or github.com/u-root/u-root/cmds/...,
+// which expand to all commands (`package main` directories) they match.
+//
+// Like with `go install path@version`, Go import paths (and patterns) may
+// have a version suffix, e.g. github.com/u-root/u-root/cmds/core/ls@v0.11.0.
+// Those are loaded from the module at that version, without needing a local
+// checkout.
+//
+// Named packages that are not commands are logged and skipped.
+func NewPackages(env golang.Environ, opts Opts, names ...string) ([]*bbinternal.Package, error) {
 	var goImportPaths []string
 	var filesystemPaths []string
+	var remotePaths []string
+
+	excl, err := newExcluder(opts.Excludes)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, name := range names {
-		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "/") {
-			filesystemPaths = append(filesystemPaths, name)
-		} else if _, err := os.Stat(name); err == nil {
+		if _, _, ok := splitVersion(name); ok {
+			remotePaths = append(remotePaths, name)
+		} else if isPattern(name) {
+			var expanded []string
+			if isFilesystemPath(name) {
+				expanded, err = expandFSPattern(env, name, excl, opts.Report)
+				filesystemPaths = append(filesystemPaths, expanded...)
+			} else {
+				expanded, err = expandImportPattern(env, "", name, excl)
+				goImportPaths = append(goImportPaths, expanded...)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(expanded) == 0 {
+				return nil, fmt.Errorf("pattern %q matched no commands", name)
+			}
+		} else if isFilesystemPath(name) {
+			if abs, err := filepath.Abs(name); err == nil && excl.dirExcluded(abs) {
+				continue
+			}
 			filesystemPaths = append(filesystemPaths, name)
-		} else {
+		} else if !excl.importPathExcluded(name) {
 			goImportPaths = append(goImportPaths, name)
 		}
 	}
 
+	report := opts.Report
 	var ps []*packages.Package
 	if len(goImportPaths) > 0 {
 		importPkgs, err := loadPkgs(env, "", goImportPaths...)
@@ -143,11 +217,21 @@ func NewPackages(env golang.Environ, names ...string) ([]*bbinternal.Package, er
 			return nil, fmt.Errorf("failed to load package %v: %v", goImportPaths, err)
 		}
 		for _, p := range importPkgs {
-			ps = addPkg(ps, p)
+			ps = addPkg(report, ps, p)
 		}
 	}
 
-	pkgs, err := loadFSPackages(env, filesystemPaths)
+	if len(remotePaths) > 0 {
+		remotePkgs, err := loadRemotePkgs(env, remotePaths, excl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load remote packages %v: %v", remotePaths, err)
+		}
+		for _, p := range remotePkgs {
+			ps = addPkg(report, ps, p)
+		}
+	}
+
+	pkgs, err := loadFSPackages(env, report, filesystemPaths)
 	if err != nil {
 		return nil, fmt.Errorf("could not load packages from file system: %v", err)
 	}
@@ -155,6 +239,9 @@ func NewPackages(env golang.Environ, names ...string) ([]*bbinternal.Package, er
 
 	var ips []*bbinternal.Package
 	for _, p := range ps {
+		if excl.pkgExcluded(p) {
+			continue
+		}
 		ips = append(ips, bbinternal.NewPackage(path.Base(p.PkgPath), p))
 	}
 	return ips, nil
@@ -163,7 +250,7 @@ func NewPackages(env golang.Environ, names ...string) ([]*bbinternal.Package, er
 // loadFSPkgs looks up importDirs packages, making the import path relative to
 // `dir`. `go list -json` requires the import path to be relative to the dir
 // when the package is outside of a $GOPATH and there is no go.mod in any parent directory.
-func loadFSPkgs(env golang.Environ, dir string, importDirs ...string) ([]*packages.Package, error) {
+func loadFSPkgs(env golang.Environ, report diag.Handler, dir string, importDirs ...string) ([]*packages.Package, error) {
 	// Eligibility check: does each directory contain files that are
 	// compilable under the current GOROOT/GOPATH/GOOS/GOARCH and build
 	// tags?
@@ -200,6 +287,7 @@ func loadFSPkgs(env golang.Environ, dir string, importDirs ...string) ([]*packag
 			compilableImportDirs = append(compilableImportDirs, importDir)
 		} else {
 			log.Printf("Skipping directory %s because build constraints exclude all Go files", importDir)
+			report.Report(&diag.SkippedCommand{Path: importDir, Reason: diag.BuildConstraints})
 		}
 	}
 
@@ -228,7 +316,7 @@ func loadFSPkgs(env golang.Environ, dir string, importDirs ...string) ([]*packag
 func loadPkgs(env golang.Environ, dir string, patterns ...string) ([]*packages.Package, error) {
 	cfg := &packages.Config{
 		Mode: packages.NeedName | packages.NeedImports | packages.NeedFiles | packages.NeedDeps | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedCompiledGoFiles | packages.NeedModule,
-		Env:  append(os.Environ(), env.Env()...),
+		Env:  env.CmdEnv(),
 		Dir:  dir,
 	}
 	return packages.Load(cfg, patterns...)
@@ -10,6 +10,9 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+	"github.com/u-root/gobusybox/src/pkg/golang"
 )
 
 func TestModules(t *testing.T) {
@@ -68,3 +71,94 @@ func TestModules(t *testing.T) {
 		t.Errorf("modules() no module pkgs = %v, want %v", noModulePkgs, wantNoModule)
 	}
 }
+
+func TestMatchPattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"github.com/u-root/u-root/cmds/...", "github.com/u-root/u-root/cmds", true},
+		{"github.com/u-root/u-root/cmds/...", "github.com/u-root/u-root/cmds/core/ls", true},
+		{"github.com/u-root/u-root/cmds/...", "github.com/u-root/u-root/cmdsfoo", false},
+		{"github.com/u-root/u-root/cmds/.../ls", "github.com/u-root/u-root/cmds/core/ls", true},
+		{"github.com/u-root/u-root/cmds/core/ls", "github.com/u-root/u-root/cmds/core/ls", true},
+		{"github.com/u-root/u-root/cmds/core/ls", "github.com/u-root/u-root/cmds/core/lsx", false},
+	} {
+		if got := matchPattern(tt.pattern)(tt.name); got != tt.want {
+			t.Errorf("matchPattern(%q)(%q) = %t, want %t", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpandFSPattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-expand-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"mod1/go.mod":                         "module mod1\n",
+		"mod1/cmds/core/cmd1/main.go":         "package main\n",
+		"mod1/cmds/core/cmd2/main.go":         "package main\n",
+		"mod1/cmds/exp/cmd3/main.go":          "package main\n",
+		"mod1/cmds/exp/cmd3/testdata/x/x.go":  "package main\n",
+		"mod1/cmds/nested/go.mod":             "module nested\n",
+		"mod1/cmds/nested/cmd4/main.go":       "package main\n",
+		"mod1/cmds/pkg/lib/lib.go":            "package lib\n",
+		"mod1/cmds/pkg/lib/gen.go":            "// +build ignore\n\npackage main\n",
+		"mod1/cmds/plan9only/main.go":         "// +build plan9\n\npackage main\n",
+		"mod1/cmds/testonly/main_test.go":     "package main\n",
+		"mod1/cmds/.hidden/cmd5/main.go":      "package main\n",
+		"mod1/cmds/_underscore/cmd6/main.go":  "package main\n",
+		"mod1/cmds/core/cmd1/internal/x/x.go": "package x\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	env := golang.Default()
+	env.GOOS = "linux"
+
+	excl, err := newExcluder([]string{filepath.Join(dir, "mod1/cmds/exp/...")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var skipped diag.List
+	got, err := expandFSPattern(env, filepath.Join(dir, "mod1/cmds/..."), excl, skipped.Add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like go list, the pattern stops at the nested module.
+	want := []string{
+		filepath.Join(dir, "mod1/cmds/core/cmd1"),
+		filepath.Join(dir, "mod1/cmds/core/cmd2"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandFSPattern() = %v, want %v", got, want)
+	}
+	wantSkipped := diag.List{
+		&diag.SkippedCommand{Path: filepath.Join(dir, "mod1/cmds/plan9only"), Reason: diag.BuildConstraints},
+	}
+	if !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("expandFSPattern() skipped %v, want %v", skipped, wantSkipped)
+	}
+
+	// Without modules, there are no module boundaries.
+	env.GO111MODULE = "off"
+	got, err = expandFSPattern(env, filepath.Join(dir, "mod1/cmds/..."), excl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, filepath.Join(dir, "mod1/cmds/nested/cmd4"))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandFSPattern() with GO111MODULE=off = %v, want %v", got, want)
+	}
+}
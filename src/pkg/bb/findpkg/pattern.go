@@ -0,0 +1,217 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package findpkg
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// isPattern returns true if name is a `go list`-style package pattern.
+func isPattern(name string) bool {
+	return strings.Contains(name, "...")
+}
+
+// isFilesystemPath returns true if name refers to a directory rather than a
+// Go import path.
+func isFilesystemPath(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "/") {
+		return true
+	}
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// matchPattern returns a function that matches names against a `go list`
+// style pattern, in which "..." matches any string, and a trailing "/..."
+// also matches the empty string.
+//
+// E.g. x/... matches x as well as x/y/z.
+func matchPattern(pattern string) func(name string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	reg := regexp.MustCompile(`^` + re + `$`)
+	return reg.MatchString
+}
+
+// excluder matches packages against exclusion patterns.
+type excluder struct {
+	dirs        []func(string) bool
+	importPaths []func(string) bool
+}
+
+func newExcluder(excludes []string) (*excluder, error) {
+	e := &excluder{}
+	for _, x := range excludes {
+		if isFilesystemPath(x) {
+			abs, err := filepath.Abs(x)
+			if err != nil {
+				return nil, fmt.Errorf("could not make exclusion %q absolute: %v", x, err)
+			}
+			e.dirs = append(e.dirs, matchPattern(abs))
+		} else {
+			e.importPaths = append(e.importPaths, matchPattern(x))
+		}
+	}
+	return e, nil
+}
+
+func (e *excluder) dirExcluded(dir string) bool {
+	for _, m := range e.dirs {
+		if m(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *excluder) importPathExcluded(importPath string) bool {
+	for _, m := range e.importPaths {
+		if m(importPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// pkgExcluded returns true if p's import path or directory is excluded.
+func (e *excluder) pkgExcluded(p *packages.Package) bool {
+	if e.importPathExcluded(p.PkgPath) {
+		return true
+	}
+	return len(p.GoFiles) > 0 && e.dirExcluded(filepath.Dir(p.GoFiles[0]))
+}
+
+// isCommandDir returns true if dir contains Go files of package main that
+// match the build constraints of env. excluded is true if dir is a command
+// for other platforms or build tags: none of its Go files match the build
+// constraints, but some of them are package main.
+func isCommandDir(env golang.Environ, dir string) (isCmd, excluded bool, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, false, err
+	}
+	fset := token.NewFileSet()
+	var matched, excludedMain bool
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		match, err := env.Context.MatchFile(dir, name)
+		if err != nil {
+			return false, false, fmt.Errorf("could not determine Go build constraints of %s: %v", dir, err)
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.PackageClauseOnly)
+		if err != nil {
+			// Let the package loader report broken files.
+			continue
+		}
+		if !match {
+			excludedMain = excludedMain || f.Name.Name == "main"
+			continue
+		}
+		matched = true
+		if f.Name.Name == "main" {
+			return true, false, nil
+		}
+	}
+	return false, !matched && excludedMain, nil
+}
+
+// expandFSPattern returns all command directories matching the file system
+// pattern, e.g. ./cmds/....
+//
+// Like `go list`, directories beginning with . or _ as well as testdata
+// directories are ignored, and in module mode the pattern does not reach into
+// nested modules, i.e. directories with their own go.mod. Commands excluded
+// by build constraints are reported as skipped.
+func expandFSPattern(env golang.Environ, pattern string, excl *excluder, report diag.Handler) ([]string, error) {
+	abs, err := filepath.Abs(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("could not make pattern %q absolute: %v", pattern, err)
+	}
+	match := matchPattern(abs)
+
+	// Walk from the longest directory prefix without wildcards.
+	root := abs[:strings.Index(abs, "...")]
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root = filepath.Dir(root)
+	}
+	root = filepath.Clean(root)
+
+	var dirs []string
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root {
+			if base := filepath.Base(path); strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") || base == "testdata" || base == "vendor" {
+				return filepath.SkipDir
+			}
+			if env.GO111MODULE != "off" {
+				if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+		}
+		if !match(path) || excl.dirExcluded(path) {
+			return nil
+		}
+		if isCmd, excluded, err := isCommandDir(env, path); err != nil {
+			return err
+		} else if isCmd {
+			dirs = append(dirs, path)
+		} else if excluded {
+			log.Printf("Skipping command %s because build constraints exclude all its Go files", path)
+			report.Report(&diag.SkippedCommand{Path: path, Reason: diag.BuildConstraints})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not expand pattern %q: %v", pattern, err)
+	}
+	return dirs, nil
+}
+
+// expandImportPattern returns the import paths of all commands matching the
+// import path pattern, e.g. github.com/u-root/u-root/cmds/core/..., as
+// resolved by the go command in dir.
+func expandImportPattern(env golang.Environ, dir, pattern string, excl *excluder) ([]string, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles,
+		Env:  env.CmdEnv(),
+		Dir:  dir,
+	}
+	pkgs, err := packages.Load(cfg, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("could not expand pattern %q: %v", pattern, err)
+	}
+	var importPaths []string
+	for _, p := range pkgs {
+		if p.Name == "main" && len(p.GoFiles) > 0 && !excl.importPathExcluded(p.PkgPath) {
+			importPaths = append(importPaths, p.PkgPath)
+		}
+	}
+	return importPaths, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package findpkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// splitVersion splits a `path@version` name, as accepted by `go install
+// path@version`, into its package path (or pattern) and version.
+func splitVersion(name string) (string, string, bool) {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "/") {
+		return "", "", false
+	}
+	i := strings.LastIndex(name, "@")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	if _, err := os.Stat(name); err == nil {
+		// It's a directory that happens to contain an @.
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// resolveRemote creates a synthetic main module in dir that requires the
+// modules containing all remote `path@version` names at the given versions.
+//
+// The modules are downloaded using the go command's usual GOPROXY settings,
+// so a file:// GOPROXY works for offline use.
+//
+// It returns the package paths or patterns of names without versions.
+func resolveRemote(env golang.Environ, dir string, names []string) ([]string, error) {
+	gomod := "module bb.u-root.com/remote\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0644); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, name := range names {
+		pkgPath, _, _ := splitVersion(name)
+		paths = append(paths, pkgPath)
+	}
+
+	// `go get` adds the requirement for each module at the requested
+	// version, resolving all versions with minimal version selection.
+	//
+	// -d: only download source, don't build or install anything.
+	cmd := env.GoCmd(append([]string{"get", "-d"}, names...)...)
+	cmd.Dir = dir
+	if o, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("could not resolve %v: %v\n%s", names, err, o)
+	}
+	return paths, nil
+}
+
+// loadRemotePkgs loads commands given as `path@version` names from their
+// module versions, without a local checkout of the module.
+//
+// Each package's Module is the remote module at the selected version, with
+// its source in the module cache. BuildBusybox copies those packages into the
+// generated tree just like local modules.
+//
+// The synthetic module is only used to select the commands' module versions
+// and is removed afterwards. The busybox's own dependency versions come from
+// minimal version selection over all commands' modules in the generated
+// go.mod.
+func loadRemotePkgs(env golang.Environ, names []string, excl *excluder) ([]*packages.Package, error) {
+	dir, err := ioutil.TempDir("", "bb-remote-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// Resolving versions requires module mode.
+	env.GO111MODULE = "on"
+
+	paths, err := resolveRemote(env, dir, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgPaths []string
+	for _, p := range paths {
+		if !isPattern(p) {
+			if !excl.importPathExcluded(p) {
+				pkgPaths = append(pkgPaths, p)
+			}
+			continue
+		}
+		expanded, err := expandImportPattern(env, dir, p, excl)
+		if err != nil {
+			return nil, err
+		}
+		if len(expanded) == 0 {
+			return nil, fmt.Errorf("pattern %q matched no commands", p)
+		}
+		pkgPaths = append(pkgPaths, expanded...)
+	}
+	if len(pkgPaths) == 0 {
+		return nil, nil
+	}
+	return loadPkgs(env, dir, pkgPaths...)
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package findpkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/zip"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+func TestSplitVersion(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		path    string
+		version string
+		ok      bool
+	}{
+		{"github.com/u-root/u-root/cmds/core/ls@v0.11.0", "github.com/u-root/u-root/cmds/core/ls", "v0.11.0", true},
+		{"github.com/u-root/u-root/cmds/core/...@latest", "github.com/u-root/u-root/cmds/core/...", "latest", true},
+		{"github.com/u-root/u-root/cmds/core/ls", "", "", false},
+		{"./foo@v1", "", "", false},
+		{"foo@", "", "", false},
+	} {
+		path, version, ok := splitVersion(tt.name)
+		if path != tt.path || version != tt.version || ok != tt.ok {
+			t.Errorf("splitVersion(%q) = %q, %q, %t, want %q, %q, %t", tt.name, path, version, ok, tt.path, tt.version, tt.ok)
+		}
+	}
+}
+
+// writeProxyModule writes module modPath@version with the given files into a
+// file:// GOPROXY directory. Several versions of a module may be written.
+func writeProxyModule(t *testing.T, proxyDir, modPath, version string, files map[string]string) {
+	t.Helper()
+	src, err := ioutil.TempDir("", "test-module-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vdir := filepath.Join(proxyDir, modPath, "@v")
+	if err := os.MkdirAll(vdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	list, err := os.OpenFile(filepath.Join(vdir, "list"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	if _, err := list.WriteString(version + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vdir, version+".info"), []byte(`{"Version":"`+version+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vdir, version+".mod"), []byte(files["go.mod"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	z, err := os.Create(filepath.Join(vdir, version+".zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	if err := zip.CreateFromDir(z, module.Version{Path: modPath, Version: version}, src); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setenv sets key to value and returns a func restoring the old value.
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestResolveRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-remote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	proxyDir := filepath.Join(dir, "proxy")
+	writeProxyModule(t, proxyDir, "example.com/remote", "v1.0.0", map[string]string{
+		"go.mod":             "module example.com/remote\n",
+		"cmds/hello/main.go": "package main\n\nfunc main() {}\n",
+		"cmds/bye/main.go":   "package main\n\nfunc main() {}\n",
+		"pkg/lib/lib.go":     "package lib\n",
+	})
+
+	defer setenv("GOPROXY", "file://"+filepath.ToSlash(proxyDir))()
+	defer setenv("GOSUMDB", "off")()
+	defer setenv("GOFLAGS", "-modcacherw")()
+
+	env := golang.Default()
+	env.GOPATH = filepath.Join(dir, "gopath")
+	env.GO111MODULE = "on"
+
+	mainDir := filepath.Join(dir, "main")
+	if err := os.MkdirAll(mainDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := resolveRemote(env, mainDir, []string{"example.com/remote/cmds/...@v1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/remote/cmds/..."}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("resolveRemote() = %v, want %v", paths, want)
+	}
+	gomod, err := ioutil.ReadFile(filepath.Join(mainDir, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(gomod), "example.com/remote v1.0.0") {
+		t.Errorf("go.mod does not require example.com/remote v1.0.0:\n%s", gomod)
+	}
+
+	excl, err := newExcluder([]string{"example.com/remote/cmds/bye"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := expandImportPattern(env, mainDir, paths[0], excl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/remote/cmds/hello"}; !reflect.DeepEqual(cmds, want) {
+		t.Errorf("expandImportPattern() = %v, want %v", cmds, want)
+	}
+}
+
+func TestLoadRemotePkgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-remote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// hello and bye require different versions of lib. Resolving them
+	// together selects the newer one for both.
+	proxyDir := filepath.Join(dir, "proxy")
+	for _, v := range []string{"v1.1.0", "v1.2.0"} {
+		writeProxyModule(t, proxyDir, "example.com/lib", v, map[string]string{
+			"go.mod": "module example.com/lib\n",
+			"lib.go": "package lib\n\nconst Version = \"" + v + "\"\n",
+		})
+	}
+	writeProxyModule(t, proxyDir, "example.com/hello", "v1.0.0", map[string]string{
+		"go.mod":  "module example.com/hello\n\nrequire example.com/lib v1.1.0\n",
+		"main.go": "package main\n\nimport \"example.com/lib\"\n\nfunc main() { println(lib.Version) }\n",
+	})
+	writeProxyModule(t, proxyDir, "example.com/bye", "v1.0.0", map[string]string{
+		"go.mod":  "module example.com/bye\n\nrequire example.com/lib v1.2.0\n",
+		"main.go": "package main\n\nimport \"example.com/lib\"\n\nfunc main() { println(lib.Version) }\n",
+	})
+
+	defer setenv("GOPROXY", "file://"+filepath.ToSlash(proxyDir))()
+	defer setenv("GOSUMDB", "off")()
+	defer setenv("GOFLAGS", "-modcacherw")()
+
+	env := golang.Default()
+	env.GOPATH = filepath.Join(dir, "gopath")
+
+	excl, err := newExcluder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := loadRemotePkgs(env, []string{"example.com/hello@v1.0.0", "example.com/bye@v1.0.0"}, excl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range pkgs {
+		if p.Module == nil {
+			t.Fatalf("package %s has no module", p.PkgPath)
+		}
+		if !strings.HasPrefix(p.Module.Dir, env.GOPATH) {
+			t.Errorf("module of %s is in %s, want module cache", p.PkgPath, p.Module.Dir)
+		}
+		lib, ok := p.Imports["example.com/lib"]
+		if !ok || lib.Module == nil {
+			t.Fatalf("package %s does not import example.com/lib", p.PkgPath)
+		}
+		got = append(got, p.PkgPath+"@"+p.Module.Version+" lib@"+lib.Module.Version)
+	}
+	want := []string{"example.com/hello@v1.0.0 lib@v1.2.0", "example.com/bye@v1.0.0 lib@v1.2.0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadRemotePkgs() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package genfs is the writable file system busybox source is generated into.
+//
+// OS writes to disk. Mem keeps the files in memory, so that a generated tree
+// can be inspected, or streamed into an archive or overlay, without a
+// temporary directory.
+package genfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FS is a writable file system.
+//
+// Paths are OS file paths. Implementations must be safe for concurrent use.
+type FS interface {
+	// MkdirAll creates the directory path and any missing parents with
+	// permission bits perm. It does nothing if path is a directory.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// WriteFile writes data to the file path, whose directory must
+	// exist, creating it with permission bits perm or truncating it.
+	WriteFile(path string, data []byte, perm os.FileMode) error
+}
+
+// OS is the operating system's file system.
+type OS struct{}
+
+// MkdirAll implements FS.MkdirAll with os.MkdirAll.
+func (OS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// WriteFile implements FS.WriteFile with ioutil.WriteFile.
+func (OS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(path, data, perm)
+}
+
+// Default returns fsys, or OS if fsys is nil.
+func Default(fsys FS) FS {
+	if fsys == nil {
+		return OS{}
+	}
+	return fsys
+}
+
+// CopyFile copies the file src on disk to dst in fsys, keeping its
+// permission bits.
+//
+// As with os.Open, the error satisfies os.IsNotExist if src does not exist.
+func CopyFile(fsys FS, src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("cannot copy %s: not a regular file", src)
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return fsys.WriteFile(dst, data, fi.Mode().Perm())
+}
+
+// File is a file in Mem.
+type File struct {
+	Data []byte
+	Perm os.FileMode
+}
+
+// Mem is an in-memory file system. The zero value is an empty file system.
+type Mem struct {
+	mu    sync.Mutex
+	dirs  map[string]os.FileMode
+	files map[string]File
+}
+
+// isDir returns whether path is a directory. The root is always one.
+func (m *Mem) isDir(path string) bool {
+	if _, ok := m.dirs[path]; ok {
+		return true
+	}
+	return filepath.Dir(path) == path
+}
+
+// MkdirAll implements FS.MkdirAll.
+func (m *Mem) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs == nil {
+		m.dirs = make(map[string]os.FileMode)
+	}
+
+	path = filepath.Clean(path)
+	var missing []string
+	for p := path; !m.isDir(p); p = filepath.Dir(p) {
+		if _, ok := m.files[p]; ok {
+			return &os.PathError{Op: "mkdir", Path: p, Err: fmt.Errorf("not a directory")}
+		}
+		missing = append(missing, p)
+	}
+	for _, p := range missing {
+		m.dirs[p] = perm.Perm()
+	}
+	return nil
+}
+
+// WriteFile implements FS.WriteFile.
+func (m *Mem) WriteFile(path string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = make(map[string]File)
+	}
+
+	path = filepath.Clean(path)
+	if !m.isDir(filepath.Dir(path)) {
+		return &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	if m.isDir(path) {
+		return &os.PathError{Op: "open", Path: path, Err: fmt.Errorf("is a directory")}
+	}
+	if f, ok := m.files[path]; ok {
+		// Like os.WriteFile, keep the permissions of existing files.
+		perm = f.Perm
+	}
+	m.files[path] = File{
+		Data: append([]byte(nil), data...),
+		Perm: perm.Perm(),
+	}
+	return nil
+}
+
+// ReadFile returns the contents of the file path.
+func (m *Mem) ReadFile(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[filepath.Clean(path)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), f.Data...), nil
+}
+
+// Files returns all files in m by path.
+func (m *Mem) Files() map[string]File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := make(map[string]File, len(m.files))
+	for path, f := range m.files {
+		files[path] = File{Data: append([]byte(nil), f.Data...), Perm: f.Perm}
+	}
+	return files
+}
+
+// Dirs returns the paths of all directories in m, sorted.
+func (m *Mem) Dirs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var dirs []string
+	for path := range m.dirs {
+		dirs = append(dirs, path)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
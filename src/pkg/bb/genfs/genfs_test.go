@@ -0,0 +1,92 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package genfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMem(t *testing.T) {
+	var m Mem
+	if err := m.WriteFile("/gen/a.go", []byte("a"), 0644); !os.IsNotExist(err) {
+		t.Errorf("WriteFile without parent = %v, want not exist", err)
+	}
+	if err := m.MkdirAll("/gen/pkg", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MkdirAll("/gen", 0700); err != nil {
+		t.Errorf("MkdirAll of existing dir = %v, want nil", err)
+	}
+	if err := m.WriteFile("/gen/pkg/a.go", []byte("a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Rewriting a file keeps its permissions.
+	if err := m.WriteFile("/gen/pkg/a.go", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFile("/gen/pkg", nil, 0644); err == nil {
+		t.Errorf("WriteFile of dir = nil, want error")
+	}
+	if err := m.MkdirAll("/gen/pkg/a.go/b", 0755); err == nil {
+		t.Errorf("MkdirAll under file = nil, want error")
+	}
+
+	if got, err := m.ReadFile("/gen/pkg/../pkg/a.go"); err != nil || string(got) != "b" {
+		t.Errorf("ReadFile = %q, %v, want b", got, err)
+	}
+	if _, err := m.ReadFile("/gen/b.go"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of missing file = %v, want not exist", err)
+	}
+	wantFiles := map[string]File{"/gen/pkg/a.go": {Data: []byte("b"), Perm: 0755}}
+	if got := m.Files(); !reflect.DeepEqual(got, wantFiles) {
+		t.Errorf("Files() = %v, want %v", got, wantFiles)
+	}
+	if got, want := m.Dirs(), []string{"/gen", "/gen/pkg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Dirs() = %v, want %v", got, want)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "genfs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "go.mod")
+	if err := ioutil.WriteFile(src, []byte("module example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var m Mem
+	if err := m.MkdirAll("/gen", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyFile(&m, src, "/gen/go.mod"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]File{"/gen/go.mod": {Data: []byte("module example.com\n"), Perm: 0600}}
+	if got := m.Files(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Files() = %v, want %v", got, want)
+	}
+	if err := CopyFile(&m, filepath.Join(dir, "go.sum"), "/gen/go.sum"); !os.IsNotExist(err) {
+		t.Errorf("CopyFile of missing file = %v, want not exist", err)
+	}
+	if err := CopyFile(&m, dir, "/gen/dir"); err == nil {
+		t.Errorf("CopyFile of dir = nil, want error")
+	}
+
+	dst := filepath.Join(dir, "copy")
+	if err := CopyFile(Default(nil), src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "module example.com\n" {
+		t.Errorf("ReadFile(%s) = %q, %v", dst, b, err)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"golang.org/x/tools/txtar"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/genfs"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// goldenFixtures are busyboxes of the fixtures in ../../../test whose
+// generated source is checked in as testdata/<name>.txtar.
+//
+// Fixtures that need the network to resolve dependencies are left out.
+var goldenFixtures = []struct {
+	name string
+	cmds []string
+}{
+	{"normaldeps", []string{"normaldeps/mod1/cmd/getppid", "normaldeps/mod1/cmd/helloworld"}},
+	{"diamonddep", []string{"diamonddep/mod1/cmd/hellowithdep", "diamonddep/mod1/cmd/helloworld"}},
+	{"implicitimport", []string{"implicitimport/cmd/loghello"}},
+	{"nameconflict", []string{"nameconflict/cmd/nameconflict"}},
+	{"12-fancy-cmd", []string{"12-fancy-cmd"}},
+}
+
+// generateTree generates the busybox source of cmds, relative to testDir, and
+// returns the generated files with testDir and the generated source
+// directory replaced by placeholders. If inMem is true, the source is
+// generated into a genfs.Mem instead of disk.
+func generateTree(t *testing.T, testDir string, cmds []string, inMem bool) map[string][]byte {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bb-golden-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for _, cmd := range cmds {
+		paths = append(paths, filepath.Join(testDir, cmd))
+	}
+	env := golang.Default()
+	// A toolchain set in the environment would end up in go.mod.
+	env.GOTOOLCHAIN = ""
+	genDir := filepath.Join(dir, "gen")
+	opts := &Opts{
+		Env:          env,
+		GenSrcDir:    genDir,
+		CommandPaths: paths,
+		GenerateOnly: true,
+	}
+	var mem genfs.Mem
+	if inMem {
+		opts.FS = &mem
+	}
+	if err := BuildBusybox(opts); err != nil {
+		t.Fatalf("BuildBusybox(%v) = %v", cmds, err)
+	}
+
+	var files map[string][]byte
+	if inMem {
+		if _, err := os.Stat(genDir); !os.IsNotExist(err) {
+			t.Errorf("generating into memory touched %s on disk", genDir)
+		}
+		files = make(map[string][]byte)
+		for path, f := range mem.Files() {
+			rel, err := filepath.Rel(genDir, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[filepath.ToSlash(rel)] = bytes.Replace(f.Data, []byte(genDir), []byte("$GENSRCDIR"), -1)
+		}
+	} else {
+		files, err = readTree(genDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range files {
+		files[name] = bytes.Replace(data, []byte(testDir), []byte("$TESTDIR"), -1)
+	}
+	return files
+}
+
+func TestGoldenTrees(t *testing.T) {
+	testDir, err := filepath.Abs("../../../test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range goldenFixtures {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generateTree(t, testDir, tt.cmds, false)
+
+			for _, d := range diffFiles(got, generateTree(t, testDir, tt.cmds, true)) {
+				t.Errorf("generated into genfs.Mem: %s", d)
+			}
+
+			// The generated source must not depend on the order
+			// commands are given in.
+			reversed := make([]string, len(tt.cmds))
+			for i, cmd := range tt.cmds {
+				reversed[len(tt.cmds)-1-i] = cmd
+			}
+			for _, d := range diffFiles(got, generateTree(t, testDir, reversed, false)) {
+				t.Errorf("reversed command order: %s", d)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".txtar")
+			got = stripTemplates(t, got)
+			archive := toArchive(got)
+			archive.Comment = []byte(templateComment)
+			if *update {
+				if err := os.MkdirAll("testdata", 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(golden, txtar.Format(archive), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			a, err := txtar.ParseFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create golden files)", err)
+			}
+			// Compare what would be written, since txtar adds
+			// missing trailing newlines.
+			got = fromArchive(txtar.Parse(txtar.Format(archive)))
+			for _, d := range diffFiles(fromArchive(a), got) {
+				t.Errorf("golden vs generated: %s", d)
+			}
+		})
+	}
+}
+
+const (
+	bbMainPath     = "src/bb.u-root.com/bb/main.go"
+	bbRegisterPath = "src/bb.u-root.com/bb/pkg/bbmain/register.go"
+)
+
+const templateComment = `The bbmain templates are left out: pkg/bbmain/register.go is a copy of
+bbmain/register.go, and main.go is bbmain/cmd/main.go with blank imports of
+the command packages listed here.
+`
+
+// stripTemplates returns files without the bbmain template files, which are
+// the same in every busybox but for the commands main.go imports, so that
+// golden files only cover what is generated from the commands.
+func stripTemplates(t *testing.T, files map[string][]byte) map[string][]byte {
+	t.Helper()
+	stripped := make(map[string][]byte)
+	for name, data := range files {
+		stripped[name] = data
+	}
+
+	if !bytes.Equal(stripped[bbRegisterPath], bbRegisterSource) {
+		t.Errorf("%s is not a copy of bbmain/register.go", bbRegisterPath)
+	}
+	delete(stripped, bbRegisterPath)
+
+	f, err := parser.ParseFile(token.NewFileSet(), bbMainPath, stripped[bbMainPath], parser.ImportsOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imports bytes.Buffer
+	for _, imp := range f.Imports {
+		if imp.Name != nil && imp.Name.Name == "_" {
+			fmt.Fprintf(&imports, "%s\n", imp.Path.Value)
+		}
+	}
+	stripped[bbMainPath] = imports.Bytes()
+	return stripped
+}
+
+func sortedFiles(files map[string][]byte) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func toArchive(files map[string][]byte) *txtar.Archive {
+	var a txtar.Archive
+	for _, name := range sortedFiles(files) {
+		a.Files = append(a.Files, txtar.File{Name: name, Data: files[name]})
+	}
+	return &a
+}
+
+func fromArchive(a *txtar.Archive) map[string][]byte {
+	files := make(map[string][]byte)
+	for _, f := range a.Files {
+		files[f.Name] = f.Data
+	}
+	return files
+}
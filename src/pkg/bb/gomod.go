@@ -0,0 +1,221 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+)
+
+// goDirectives are the go.mod directives that select the Go language version
+// and toolchain.
+type goDirectives struct {
+	// Go is the `go` directive's version, e.g. 1.22 or 1.22.0.
+	Go string
+
+	// Toolchain is the `toolchain` directive's toolchain, e.g. go1.22.3.
+	Toolchain string
+}
+
+// goDirectivesOf returns the go and toolchain directives of f.
+func goDirectivesOf(f *modfile.File) goDirectives {
+	var d goDirectives
+	if f.Go != nil {
+		d.Go = f.Go.Version
+	}
+	if f.Toolchain != nil {
+		d.Toolchain = f.Toolchain.Name
+	}
+	return d
+}
+
+// addGoDirectives adds d to f.
+func addGoDirectives(f *modfile.File, d goDirectives) error {
+	if d.Go != "" {
+		if err := f.AddGoStmt(d.Go); err != nil {
+			return err
+		}
+	}
+	if d.Toolchain != "" {
+		if err := f.AddToolchainStmt(d.Toolchain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// goVersion is a parsed Go version such as 1.21, 1.21rc1 or 1.21.3.
+type goVersion struct {
+	major, minor int
+
+	// kind orders language versions (1.21) before betas (1.21beta1),
+	// release candidates (1.21rc1) and releases (1.21.0).
+	kind int
+
+	// n is the beta, rc or patch number.
+	n int
+}
+
+func parseGoVersion(v string) (goVersion, bool) {
+	v = strings.TrimPrefix(v, "go")
+	var gv goVersion
+	dot := strings.Index(v, ".")
+	if dot < 0 {
+		return gv, false
+	}
+	var err error
+	if gv.major, err = strconv.Atoi(v[:dot]); err != nil {
+		return gv, false
+	}
+	rest := v[dot+1:]
+	end := strings.IndexAny(rest, ".br")
+	if end < 0 {
+		end = len(rest)
+	}
+	if gv.minor, err = strconv.Atoi(rest[:end]); err != nil {
+		return gv, false
+	}
+	rest = rest[end:]
+	switch {
+	case rest == "":
+		return gv, true
+	case strings.HasPrefix(rest, "beta"):
+		gv.kind, rest = 1, rest[len("beta"):]
+	case strings.HasPrefix(rest, "rc"):
+		gv.kind, rest = 2, rest[len("rc"):]
+	case strings.HasPrefix(rest, "."):
+		gv.kind, rest = 3, rest[len("."):]
+	default:
+		return gv, false
+	}
+	if gv.n, err = strconv.Atoi(rest); err != nil {
+		return gv, false
+	}
+	return gv, true
+}
+
+// compareGoVersions compares the Go versions a and b like the go command
+// does, returning -1, 0 or 1. Invalid versions are considered older than
+// valid ones.
+func compareGoVersions(a, b string) int {
+	va, oka := parseGoVersion(a)
+	vb, okb := parseGoVersion(b)
+	switch {
+	case !oka && !okb:
+		return strings.Compare(a, b)
+	case !oka:
+		return -1
+	case !okb:
+		return 1
+	}
+	for _, c := range [][2]int{{va.major, vb.major}, {va.minor, vb.minor}, {va.kind, vb.kind}, {va.n, vb.n}} {
+		if c[0] < c[1] {
+			return -1
+		} else if c[0] > c[1] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// mergeGoDirectives returns the go and toolchain directives for a main module
+// that requires all modules with directives mods.
+//
+// The go command requires the main module's go version to be at least that
+// of every module in the build, so the maximum of all versions is used. The
+// toolchain is only kept if it is newer than the go version.
+func mergeGoDirectives(mods map[string]goDirectives) goDirectives {
+	var d goDirectives
+	for _, m := range mods {
+		if m.Go != "" && compareGoVersions(m.Go, d.Go) > 0 {
+			d.Go = m.Go
+		}
+		if m.Toolchain != "" && compareGoVersions(m.Toolchain, d.Toolchain) > 0 {
+			d.Toolchain = m.Toolchain
+		}
+	}
+	if d.Toolchain != "" && compareGoVersions(d.Toolchain, d.Go) <= 0 {
+		d.Toolchain = ""
+	}
+	return d
+}
+
+// semanticChanges are Go versions at which the default GODEBUG settings, and
+// with them the behavior of existing code, change. Defaults are chosen by
+// the main module's go version.
+//
+// In a busybox, the generated module is the main module, so all commands get
+// the behavior of the merged go version. (Language changes such as loop
+// variable scoping depend on each package's own module and are not affected.)
+var semanticChanges = []struct {
+	version string
+	change  string
+}{
+	{"1.21", "panic(nil) panics with *runtime.PanicNilError (GODEBUG=panicnil)"},
+	{"1.22", "net/http.ServeMux uses enhanced patterns (GODEBUG=httpmuxgo121)"},
+	{"1.23", "time.Timer and time.Ticker channels are unbuffered (GODEBUG=asynctimerchan)"},
+}
+
+// goVersionChanges returns diagnostics for all command modules whose go
+// version is older than the busybox's go version merged, with the behavior
+// changes between the two versions.
+func goVersionChanges(cmds []*bbinternal.Package, mods map[string]goDirectives, merged string) []*diag.GoVersionChange {
+	cmdsByModule := make(map[string][]string)
+	for _, cmd := range cmds {
+		if cmd.Pkg.Module != nil {
+			cmdsByModule[cmd.Pkg.Module.Path] = append(cmdsByModule[cmd.Pkg.Module.Path], cmd.Pkg.PkgPath)
+		}
+	}
+
+	var changes []*diag.GoVersionChange
+	for mpath, pkgs := range cmdsByModule {
+		v := mods[mpath].Go
+		if v == "" {
+			// The go command assumes go 1.16 for modules without
+			// a go directive.
+			v = "1.16"
+		}
+		var cs []string
+		for _, c := range semanticChanges {
+			if compareGoVersions(v, c.version) < 0 && compareGoVersions(merged, c.version) >= 0 {
+				cs = append(cs, fmt.Sprintf("go %s: %s", c.version, c.change))
+			}
+		}
+		if len(cs) == 0 {
+			continue
+		}
+		sort.Strings(pkgs)
+		changes = append(changes, &diag.GoVersionChange{
+			Module:   mpath,
+			Version:  v,
+			Selected: merged,
+			Cmds:     pkgs,
+			Changes:  cs,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Module < changes[j].Module
+	})
+	return changes
+}
+
+// warnGoVersionChanges logs and reports goVersionChanges.
+func warnGoVersionChanges(cmds []*bbinternal.Package, mods map[string]goDirectives, merged string, report diag.Handler) {
+	for _, c := range goVersionChanges(cmds, mods, merged) {
+		log.Printf("Warning: module %s declares go %s, but the busybox uses go %s. Behavior of %s changes:", c.Module, c.Version, c.Selected, strings.Join(c.Cmds, ", "))
+		for _, change := range c.Changes {
+			log.Printf("  %s", change)
+		}
+		report.Report(c)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+)
+
+func TestGoDirectives(t *testing.T) {
+	f, err := modfile.Parse("go.mod", []byte(`module github.com/u-root/u-root
+
+go 1.22.0 // language version
+
+toolchain go1.22.3
+
+require golang.org/x/sys v0.1.0
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := goDirectivesOf(f)
+	if want := (goDirectives{Go: "1.22.0", Toolchain: "go1.22.3"}); d != want {
+		t.Errorf("goDirectivesOf() = %+v, want %+v", d, want)
+	}
+
+	var mod modfile.File
+	if err := mod.AddModuleStmt("bb.u-root.com/bb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.AddRequire("example.com/foo", "v0.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addGoDirectives(&mod, goDirectives{Go: "1.22.0", Toolchain: "go1.23.1"}); err != nil {
+		t.Fatalf("addGoDirectives() = %v", err)
+	}
+	got, err := mod.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `module bb.u-root.com/bb
+
+go 1.22.0
+
+toolchain go1.23.1
+
+require example.com/foo v0.0.0
+`
+	if string(got) != want {
+		t.Errorf("go.mod with go directives =\n%s\nwant\n%s", got, want)
+	}
+
+	if err := addGoDirectives(&mod, goDirectives{Go: "latest"}); err == nil {
+		t.Errorf("addGoDirectives(invalid go version) = nil, want error")
+	}
+}
+
+func TestCompareGoVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.21", "1.21", 0},
+		{"1.9", "1.21", -1},
+		{"1.21", "1.21rc1", -1},
+		{"1.21beta1", "1.21rc1", -1},
+		{"1.21rc2", "1.21.0", -1},
+		{"1.21.10", "1.21.9", 1},
+		{"go1.22.3", "1.22.0", 1},
+		{"", "1.16", -1},
+	} {
+		if got := compareGoVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareGoVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMergeGoDirectives(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		mods map[string]goDirectives
+		want goDirectives
+	}{
+		{
+			name: "max",
+			mods: map[string]goDirectives{
+				"a": {Go: "1.20"},
+				"b": {Go: "1.22.0", Toolchain: "go1.22.5"},
+				"c": {Go: "1.21.3", Toolchain: "go1.23.0"},
+			},
+			want: goDirectives{Go: "1.22.0", Toolchain: "go1.23.0"},
+		},
+		{
+			name: "toolchain older than go version",
+			mods: map[string]goDirectives{
+				"a": {Go: "1.23.0"},
+				"b": {Go: "1.21.0", Toolchain: "go1.22.5"},
+			},
+			want: goDirectives{Go: "1.23.0"},
+		},
+		{
+			name: "none",
+			mods: map[string]goDirectives{"a": {}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeGoDirectives(tt.mods); got != tt.want {
+				t.Errorf("mergeGoDirectives() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGoVersionChanges(t *testing.T) {
+	cmd := func(pkgPath, mod string) *bbinternal.Package {
+		return &bbinternal.Package{Pkg: &packages.Package{PkgPath: pkgPath, Module: &packages.Module{Path: mod}}}
+	}
+	cmds := []*bbinternal.Package{
+		cmd("example.com/old/cmds/b", "example.com/old"),
+		cmd("example.com/old/cmds/a", "example.com/old"),
+		cmd("example.com/new/cmds/c", "example.com/new"),
+	}
+	mods := map[string]goDirectives{
+		"example.com/old": {Go: "1.21"},
+		"example.com/new": {Go: "1.22.0"},
+	}
+	got := goVersionChanges(cmds, mods, "1.22.0")
+	want := []*diag.GoVersionChange{
+		{
+			Module:   "example.com/old",
+			Version:  "1.21",
+			Selected: "1.22.0",
+			Cmds:     []string{"example.com/old/cmds/a", "example.com/old/cmds/b"},
+			Changes:  []string{"go 1.22: " + semanticChanges[1].change},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("goVersionChanges() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+)
+
+// goSumKey identifies one go.sum line, minus its hash value.
+type goSumKey struct {
+	// Version may have a /go.mod suffix.
+	module.Version
+
+	// Algo is the hash algorithm prefix, e.g. "h1".
+	Algo string
+}
+
+type goSumEntry struct {
+	hash string
+	file string
+}
+
+// goSum merges several go.sum files.
+type goSum struct {
+	sums map[goSumKey]goSumEntry
+
+	// algos are the sorted hash algorithms present per module version.
+	algos map[module.Version][]string
+}
+
+func newGoSum() *goSum {
+	return &goSum{
+		sums:  make(map[goSumKey]goSumEntry),
+		algos: make(map[module.Version][]string),
+	}
+}
+
+// add merges the go.sum file contents data, read from file, into s.
+//
+// Duplicate lines are ignored. Two different hashes for the same module
+// version return a *diag.ChecksumConflict.
+func (s *goSum) add(file string, data []byte) error {
+	for i, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 {
+			return fmt.Errorf("%s:%d: malformed go.sum line %q", file, i+1, line)
+		}
+		colon := strings.Index(f[2], ":")
+		if colon < 0 {
+			return fmt.Errorf("%s:%d: malformed go.sum hash %q", file, i+1, f[2])
+		}
+		key := goSumKey{
+			Version: module.Version{Path: f[0], Version: f[1]},
+			Algo:    f[2][:colon],
+		}
+		if e, ok := s.sums[key]; ok {
+			if e.hash != f[2] {
+				return &diag.ChecksumConflict{
+					Module:  f[0],
+					Version: f[1],
+					Sums: []diag.Checksum{
+						{Hash: e.hash, File: e.file},
+						{Hash: f[2], File: file},
+					},
+				}
+			}
+			continue
+		}
+		s.sums[key] = goSumEntry{hash: f[2], file: file}
+		s.algos[key.Version] = append(s.algos[key.Version], key.Algo)
+		sort.Strings(s.algos[key.Version])
+	}
+	return nil
+}
+
+// addFile merges the go.sum file at path into s.
+func (s *goSum) addFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return s.add(path, data)
+}
+
+// has returns whether s has any checksum for module version v.
+func (s *goSum) has(v module.Version) bool {
+	_, ok := s.algos[v]
+	return ok
+}
+
+// format returns the merged go.sum, sorted the same way the go command sorts
+// it.
+func (s *goSum) format() []byte {
+	var mods []module.Version
+	for m := range s.algos {
+		mods = append(mods, m)
+	}
+	module.Sort(mods)
+
+	var b bytes.Buffer
+	for _, m := range mods {
+		for _, algo := range s.algos[m] {
+			fmt.Fprintf(&b, "%s %s %s\n", m.Path, m.Version, s.sums[goSumKey{Version: m, Algo: algo}].hash)
+		}
+	}
+	return b.Bytes()
+}
+
+// selectedVersions approximates the build list of the busybox module: for
+// every module that mainPkgs import packages from or that a requirement in
+// reqs names, it returns the highest version required.
+//
+// reqs are the requirements of all modules the busybox go.mod requires. Each
+// command's packages carry the versions its own module selected, which
+// include indirect requirements that older go.mod files do not list.
+func selectedVersions(mainPkgs []*packages.Package, reqs []module.Version) map[string]string {
+	versions := make(map[string]string)
+	use := func(m module.Version) {
+		if v, ok := versions[m.Path]; !ok || semver.Compare(m.Version, v) > 0 {
+			versions[m.Path] = m.Version
+		}
+	}
+	for _, r := range reqs {
+		use(r)
+	}
+	packages.Visit(mainPkgs, nil, func(p *packages.Package) {
+		if p.Module != nil && !p.Module.Main && p.Module.Version != "" {
+			use(module.Version{Path: p.Module.Path, Version: p.Module.Version})
+		}
+	})
+	return versions
+}
+
+// replacement returns the module that replaces m according to replace, and
+// whether m is replaced.
+func replacement(m module.Version, replace []*modfile.Replace) (module.Version, bool) {
+	for _, r := range replace {
+		if r.Old.Path == m.Path && (r.Old.Version == "" || r.Old.Version == m.Version) {
+			return r.New, true
+		}
+	}
+	return m, false
+}
+
+// missingSums returns checksums that the go command needs to build mainPkgs
+// in the busybox module, but that are not in s.
+//
+// The busybox module selects dependency versions over all commands' modules,
+// which may upgrade a command's dependency to a version that none of the
+// merged go.sum files has. reqs and replace are the requirements and replace
+// directives that decide those versions; see selectedVersions.
+//
+// Modules in localModules are copied into the busybox tree and need no
+// checksums.
+func missingSums(s *goSum, mainPkgs []*packages.Package, localModules map[string]*packages.Module, reqs []module.Version, replace []*modfile.Replace) []*diag.MissingChecksum {
+	selected := selectedVersions(mainPkgs, reqs)
+
+	var missing []*diag.MissingChecksum
+	seen := make(map[module.Version]struct{})
+	for _, mainPkg := range mainPkgs {
+		packages.Visit([]*packages.Package{mainPkg}, nil, func(p *packages.Package) {
+			if p.Module == nil || p.Module.Main {
+				return
+			}
+			if _, ok := localModules[p.Module.Path]; ok {
+				return
+			}
+			m := module.Version{Path: p.Module.Path, Version: selected[p.Module.Path]}
+			if r, ok := replacement(m, replace); ok {
+				if isReplacedModuleLocal(&packages.Module{Path: r.Path}) {
+					return
+				}
+				m = r
+			} else if r := p.Module.Replace; r != nil {
+				if isReplacedModuleLocal(r) {
+					return
+				}
+				m = module.Version{Path: r.Path, Version: r.Version}
+			}
+			if m.Version == "" {
+				return
+			}
+			for _, v := range []module.Version{m, {Path: m.Path, Version: m.Version + "/go.mod"}} {
+				if _, ok := seen[v]; ok {
+					continue
+				}
+				seen[v] = struct{}{}
+				if !s.has(v) {
+					missing = append(missing, &diag.MissingChecksum{
+						Module:  v.Path,
+						Version: v.Version,
+						Cmd:     mainPkg.PkgPath,
+					})
+				}
+			}
+		})
+	}
+	return missing
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+)
+
+func TestGoSumMerge(t *testing.T) {
+	s := newGoSum()
+	if err := s.add("a/go.sum", []byte(`golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c h1:VwygUrnw9jn88c4u8GD3rZQbqrP/tgas88tPUbBxQrk=
+golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c/go.mod h1:h1NjWce9XRLGQEsW7wpKNCjG9DtNlClVuFLEZdDNbEs=
+github.com/u-root/uio v0.0.0-20210528114334-82958018845c/go.mod h1:LpEX5FO/cB+WF4TYGY1V5qktpaZLkKkSegbr0V4eYXA=
+`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add("b/go.sum", []byte(`
+golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae/go.mod h1:h1NjWce9XRLGQEsW7wpKNCjG9DtNlClVuFLEZdDNbEs=
+golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c h1:VwygUrnw9jn88c4u8GD3rZQbqrP/tgas88tPUbBxQrk=
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `github.com/u-root/uio v0.0.0-20210528114334-82958018845c/go.mod h1:LpEX5FO/cB+WF4TYGY1V5qktpaZLkKkSegbr0V4eYXA=
+golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae/go.mod h1:h1NjWce9XRLGQEsW7wpKNCjG9DtNlClVuFLEZdDNbEs=
+golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c h1:VwygUrnw9jn88c4u8GD3rZQbqrP/tgas88tPUbBxQrk=
+golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c/go.mod h1:h1NjWce9XRLGQEsW7wpKNCjG9DtNlClVuFLEZdDNbEs=
+`
+	if got := string(s.format()); got != want {
+		t.Errorf("merged go.sum =\n%s\nwant\n%s", got, want)
+	}
+
+	err := s.add("c/go.sum", []byte("golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c h1:AAAAUrnw9jn88c4u8GD3rZQbqrP/tgas88tPUbBxQrk=\n"))
+	var conflict *diag.ChecksumConflict
+	if !errors.As(err, &conflict) {
+		t.Fatalf("add(conflicting hash) = %v, want ChecksumConflict", err)
+	}
+	wantConflict := &diag.ChecksumConflict{
+		Module:  "golang.org/x/sys",
+		Version: "v0.0.0-20210124154548-22da62e12c0c",
+		Sums: []diag.Checksum{
+			{Hash: "h1:VwygUrnw9jn88c4u8GD3rZQbqrP/tgas88tPUbBxQrk=", File: "a/go.sum"},
+			{Hash: "h1:AAAAUrnw9jn88c4u8GD3rZQbqrP/tgas88tPUbBxQrk=", File: "c/go.sum"},
+		},
+	}
+	if !reflect.DeepEqual(conflict, wantConflict) {
+		t.Errorf("conflict = %#v, want %#v", conflict, wantConflict)
+	}
+
+	if err := s.add("d/go.sum", []byte("golang.org/x/sys v0.1.0\n")); err == nil {
+		t.Errorf("add(malformed line) = nil, want error")
+	}
+}
+
+func TestMissingSums(t *testing.T) {
+	s := newGoSum()
+	if err := s.add("go.sum", []byte(`golang.org/x/sys v0.1.0 h1:sys=
+golang.org/x/sys v0.1.0/go.mod h1:sysmod=
+github.com/insomniacslk/dhcp v1.0.0/go.mod h1:dhcpmod=
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	uroot := &packages.Module{Path: "github.com/u-root/u-root", Main: true}
+	p9 := &packages.Module{Path: "github.com/hugelgupf/p9", Version: "v0.1.0"}
+	cmd := &packages.Package{
+		PkgPath: "github.com/u-root/u-root/cmds/core/dhclient",
+		Module:  uroot,
+		Imports: map[string]*packages.Package{
+			"golang.org/x/sys/unix": {
+				PkgPath: "golang.org/x/sys/unix",
+				Module:  &packages.Module{Path: "golang.org/x/sys", Version: "v0.1.0"},
+			},
+			"github.com/insomniacslk/dhcp/dhcpv4": {
+				PkgPath: "github.com/insomniacslk/dhcp/dhcpv4",
+				Module:  &packages.Module{Path: "github.com/insomniacslk/dhcp", Version: "v1.0.0"},
+			},
+			"github.com/hugelgupf/p9/p9": {
+				PkgPath: "github.com/hugelgupf/p9/p9",
+				Module:  p9,
+			},
+		},
+	}
+
+	got := missingSums(s, []*packages.Package{cmd}, map[string]*packages.Module{p9.Path: p9}, nil, nil)
+	want := []*diag.MissingChecksum{
+		{Module: "github.com/insomniacslk/dhcp", Version: "v1.0.0", Cmd: cmd.PkgPath},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("missingSums() = %v, want %v", got, want)
+	}
+}
+
+// TestMissingSumsUpgrade checks that checksums are needed for the versions
+// the busybox module selects, not those each command's module selected.
+func TestMissingSumsUpgrade(t *testing.T) {
+	s := newGoSum()
+	// Only a's go.sum has sums for lib, at the version a uses.
+	if err := s.add("a/go.sum", []byte(`example.com/lib v1.0.0 h1:lib=
+example.com/lib v1.0.0/go.mod h1:libmod=
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	lib := &packages.Module{Path: "example.com/lib", Version: "v1.0.0"}
+	cmd := &packages.Package{
+		PkgPath: "example.com/a/cmds/a",
+		Module:  &packages.Module{Path: "example.com/a", Main: true},
+		Imports: map[string]*packages.Package{
+			"example.com/lib": {PkgPath: "example.com/lib", Module: lib},
+		},
+	}
+	// b does not import lib's packages, but its go.mod upgrades lib.
+	reqs := []module.Version{
+		{Path: "example.com/lib", Version: "v1.0.0"},
+		{Path: "example.com/lib", Version: "v1.1.0"},
+	}
+
+	for _, tt := range []struct {
+		name    string
+		reqs    []module.Version
+		replace []*modfile.Replace
+		want    []*diag.MissingChecksum
+	}{
+		{
+			name: "no upgrade",
+			reqs: reqs[:1],
+		},
+		{
+			name: "upgrade",
+			reqs: reqs,
+			want: []*diag.MissingChecksum{
+				{Module: "example.com/lib", Version: "v1.1.0", Cmd: cmd.PkgPath},
+				{Module: "example.com/lib", Version: "v1.1.0/go.mod", Cmd: cmd.PkgPath},
+			},
+		},
+		{
+			name: "upgrade replaced by fork",
+			reqs: reqs,
+			replace: []*modfile.Replace{
+				{Old: module.Version{Path: "example.com/lib", Version: "v1.1.0"}, New: module.Version{Path: "example.com/fork", Version: "v1.1.0"}},
+			},
+			want: []*diag.MissingChecksum{
+				{Module: "example.com/fork", Version: "v1.1.0", Cmd: cmd.PkgPath},
+				{Module: "example.com/fork", Version: "v1.1.0/go.mod", Cmd: cmd.PkgPath},
+			},
+		},
+		{
+			name: "upgrade replaced by directory",
+			reqs: reqs,
+			replace: []*modfile.Replace{
+				{Old: module.Version{Path: "example.com/lib"}, New: module.Version{Path: "../lib"}},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := missingSums(s, []*packages.Package{cmd}, nil, tt.reqs, tt.replace)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingSums() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
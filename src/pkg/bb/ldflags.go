@@ -0,0 +1,122 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// mainVar returns the variable name of a main package -X definition such as
+// main.version=1.0, or false if def is not one.
+func mainVar(def string) (string, bool) {
+	if !strings.HasPrefix(def, "main.") {
+		return "", false
+	}
+	return strings.TrimPrefix(def, "main."), true
+}
+
+// expandMainVar returns -X linker flags setting the main package variable
+// def (name=value) in each of cmds' rewritten packages.
+func expandMainVar(cmds []*bbinternal.Package, def string) []string {
+	var flags []string
+	for _, cmd := range cmds {
+		flags = append(flags, "-X", cmd.Pkg.PkgPath+"."+def)
+	}
+	return flags
+}
+
+// findCmd returns the command named name, or with Go import path name.
+func findCmd(cmds []*bbinternal.Package, name string) *bbinternal.Package {
+	for _, cmd := range cmds {
+		if cmd.Name == name || cmd.Pkg.PkgPath == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// linkerFlags rewrites -X definitions of main package variables in the linker
+// flags ldflags to the packages that the commands' main packages were
+// rewritten to, and adds the -X definitions vars.
+//
+// vars are of the form [cmd:]importpath.name=value. Without cmd, a main
+// package variable is set in every command.
+func linkerFlags(cmds []*bbinternal.Package, ldflags []string, vars []string) ([]string, error) {
+	var flags []string
+	for i := 0; i < len(ldflags); i++ {
+		f := ldflags[i]
+		switch {
+		case (f == "-X" || f == "--X") && i+1 < len(ldflags):
+			if name, ok := mainVar(ldflags[i+1]); ok {
+				flags = append(flags, expandMainVar(cmds, name)...)
+				i++
+				continue
+			}
+		case strings.HasPrefix(f, "-X=") || strings.HasPrefix(f, "--X="):
+			if name, ok := mainVar(f[strings.Index(f, "=")+1:]); ok {
+				flags = append(flags, expandMainVar(cmds, name)...)
+				continue
+			}
+		}
+		flags = append(flags, f)
+	}
+
+	for _, v := range vars {
+		eq := strings.Index(v, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("linker variable %q must be of the form [cmd:]importpath.name=value", v)
+		}
+		def := v
+		var cmd *bbinternal.Package
+		if colon := strings.Index(v[:eq], ":"); colon >= 0 {
+			if cmd = findCmd(cmds, v[:colon]); cmd == nil {
+				return nil, fmt.Errorf("linker variable %q is for unknown command %q", v, v[:colon])
+			}
+			def = v[colon+1:]
+		}
+		name, isMain := mainVar(def)
+		switch {
+		case isMain && cmd != nil:
+			flags = append(flags, expandMainVar([]*bbinternal.Package{cmd}, name)...)
+		case isMain:
+			flags = append(flags, expandMainVar(cmds, name)...)
+		default:
+			flags = append(flags, "-X", def)
+		}
+	}
+	return flags, nil
+}
+
+// buildOpts returns a copy of env and opts with linker flags for cmds and
+// vars. See linkerFlags.
+//
+// -ldflags in env's GOFLAGS are rewritten as well, and moved into the
+// returned BuildOpts.
+func buildOpts(env golang.Environ, opts *golang.BuildOpts, cmds []*bbinternal.Package, vars []string) (golang.Environ, *golang.BuildOpts, error) {
+	var o golang.BuildOpts
+	if opts != nil {
+		o = *opts
+	}
+	goflagsLD, goflags, err := golang.SplitLDFlags(strings.Fields(env.GOFLAGS))
+	if err != nil {
+		return env, nil, fmt.Errorf("GOFLAGS: %v", err)
+	}
+	env.GOFLAGS = strings.Join(goflags, " ")
+	ldflags, rest, err := golang.SplitLDFlags(o.ExtraArgs)
+	if err != nil {
+		return env, nil, err
+	}
+	o.ExtraArgs = rest
+	ldflags = append(goflagsLD, ldflags...)
+	o.LDFlags, err = linkerFlags(cmds, append(ldflags, o.LDFlags...), vars)
+	if err != nil {
+		return env, nil, err
+	}
+	return env, &o, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+func TestLinkerFlags(t *testing.T) {
+	cmds := []*bbinternal.Package{
+		{Name: "ls", Pkg: &packages.Package{PkgPath: "github.com/u-root/u-root/cmds/core/ls"}},
+		{Name: "cat", Pkg: &packages.Package{PkgPath: "github.com/u-root/u-root/cmds/core/cat"}},
+	}
+	for _, tt := range []struct {
+		name    string
+		ldflags []string
+		vars    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "ldflags main vars",
+			ldflags: []string{"-s", "-X", "main.version=1.0", "-X=example.com/foo.bar=baz"},
+			want: []string{
+				"-s",
+				"-X", "github.com/u-root/u-root/cmds/core/ls.version=1.0",
+				"-X", "github.com/u-root/u-root/cmds/core/cat.version=1.0",
+				"-X=example.com/foo.bar=baz",
+			},
+		},
+		{
+			name: "per-command vars",
+			vars: []string{
+				"ls:main.version=1.1",
+				"github.com/u-root/u-root/cmds/core/cat:main.url=http://example.com",
+				"main.commit=abc",
+				"example.com/foo.bar=baz",
+			},
+			want: []string{
+				"-X", "github.com/u-root/u-root/cmds/core/ls.version=1.1",
+				"-X", "github.com/u-root/u-root/cmds/core/cat.url=http://example.com",
+				"-X", "github.com/u-root/u-root/cmds/core/ls.commit=abc",
+				"-X", "github.com/u-root/u-root/cmds/core/cat.commit=abc",
+				"-X", "example.com/foo.bar=baz",
+			},
+		},
+		{
+			name:    "unknown command",
+			vars:    []string{"dd:main.version=1.0"},
+			wantErr: true,
+		},
+		{
+			name:    "no value",
+			vars:    []string{"main.version"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := linkerFlags(cmds, tt.ldflags, tt.vars)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("linkerFlags() = %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("linkerFlags() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildOptsGOFLAGS(t *testing.T) {
+	cmds := []*bbinternal.Package{
+		{Name: "ls", Pkg: &packages.Package{PkgPath: "github.com/u-root/u-root/cmds/core/ls"}},
+	}
+	env := golang.Environ{GOFLAGS: "-mod=mod -ldflags=-X=main.version=1.0 -trimpath"}
+	opts := &golang.BuildOpts{ExtraArgs: []string{"-ldflags", "-X main.commit=abc", "-v"}}
+
+	gotEnv, got, err := buildOpts(env, opts, cmds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-mod=mod -trimpath"; gotEnv.GOFLAGS != want {
+		t.Errorf("GOFLAGS = %q, want %q", gotEnv.GOFLAGS, want)
+	}
+	if want := []string{"-v"}; !reflect.DeepEqual(got.ExtraArgs, want) {
+		t.Errorf("ExtraArgs = %q, want %q", got.ExtraArgs, want)
+	}
+	want := []string{
+		"-X", "github.com/u-root/u-root/cmds/core/ls.version=1.0",
+		"-X", "github.com/u-root/u-root/cmds/core/ls.commit=abc",
+	}
+	if !reflect.DeepEqual(got.LDFlags, want) {
+		t.Errorf("LDFlags =\n%q\nwant\n%q", got.LDFlags, want)
+	}
+}
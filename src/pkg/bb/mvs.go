@@ -0,0 +1,130 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// listModule is the subset of `go list -m -json` output we need.
+type listModule struct {
+	Path    string
+	Version string
+	Main    bool
+	Replace *listModule
+}
+
+// selectedVersion returns the version of a module that is actually built,
+// taking replace directives into account.
+//
+// Modules replaced by a local directory have no version; "" is returned.
+func selectedVersion(version string, replace *listModule) string {
+	if replace == nil {
+		return version
+	}
+	if isReplacedModuleLocal(&packages.Module{Path: replace.Path}) {
+		return ""
+	}
+	if replace.Version == "" {
+		return ""
+	}
+	return replace.Path + "@" + replace.Version
+}
+
+// parseBuildList parses the output of `go list -m -json all` into a map of
+// module path -> selected version.
+func parseBuildList(r io.Reader) (map[string]string, error) {
+	versions := make(map[string]string)
+	dec := json.NewDecoder(r)
+	for {
+		var m listModule
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse go list output: %v", err)
+		}
+		if m.Main {
+			continue
+		}
+		if v := selectedVersion(m.Version, m.Replace); v != "" {
+			versions[m.Path] = v
+		}
+	}
+	return versions, nil
+}
+
+// buildList returns the module versions minimal version selection picks for
+// the module in dir.
+func buildList(env golang.Environ, dir string) (map[string]string, error) {
+	cmd := env.GoCmd("list", "-m", "-json", "all")
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list -m all in %s failed: %v, %s", dir, err, stderr.String())
+	}
+	return parseBuildList(&stdout)
+}
+
+// cmdVersions returns the versions that cmd's own module selected for every
+// dependency module cmd imports packages from.
+func cmdVersions(cmd *packages.Package) map[string]string {
+	versions := make(map[string]string)
+	packages.Visit([]*packages.Package{cmd}, nil, func(p *packages.Package) {
+		if p.Module == nil || p.Module.Main || (cmd.Module != nil && p.Module.Path == cmd.Module.Path) {
+			return
+		}
+		var replace *listModule
+		if p.Module.Replace != nil {
+			replace = &listModule{Path: p.Module.Replace.Path, Version: p.Module.Replace.Version}
+		}
+		if v := selectedVersion(p.Module.Version, replace); v != "" {
+			versions[p.Module.Path] = v
+		}
+	})
+	return versions
+}
+
+// auditDeps compares every command's dependency versions against the busybox
+// build list and returns all dependencies whose version changed, sorted by
+// command and module.
+//
+// Modules that are local to either the command or the busybox are not
+// compared; their contents are copied into the busybox as is.
+func auditDeps(cmds []*bbinternal.Package, buildList map[string]string) []*diag.DependencyUpgrade {
+	var upgrades []*diag.DependencyUpgrade
+	for _, cmd := range cmds {
+		for mpath, v := range cmdVersions(cmd.Pkg) {
+			selected, ok := buildList[mpath]
+			if !ok || selected == v {
+				continue
+			}
+			upgrades = append(upgrades, &diag.DependencyUpgrade{
+				Cmd:      cmd.Pkg.PkgPath,
+				Module:   mpath,
+				Version:  v,
+				Selected: selected,
+			})
+		}
+	}
+	sort.Slice(upgrades, func(i, j int) bool {
+		if upgrades[i].Cmd != upgrades[j].Cmd {
+			return upgrades[i].Cmd < upgrades[j].Cmd
+		}
+		return upgrades[i].Module < upgrades[j].Module
+	})
+	return upgrades
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/bb/diag"
+)
+
+func TestParseBuildList(t *testing.T) {
+	out := `{
+	"Path": "bb.u-root.com/bb",
+	"Main": true
+}
+{
+	"Path": "github.com/u-root/u-root",
+	"Version": "v0.0.0",
+	"Replace": {"Path": "../../github.com/u-root/u-root"}
+}
+{
+	"Path": "github.com/insomniacslk/dhcp",
+	"Version": "v0.0.0-20210120172423-cc9239ac6294"
+}
+{
+	"Path": "golang.org/x/sys",
+	"Version": "v0.0.0-20210124154548-22da62e12c0c",
+	"Replace": {"Path": "github.com/fork/sys", "Version": "v0.1.0"}
+}
+`
+	got, err := parseBuildList(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"github.com/insomniacslk/dhcp": "v0.0.0-20210120172423-cc9239ac6294",
+		"golang.org/x/sys":             "github.com/fork/sys@v0.1.0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBuildList() = %v, want %v", got, want)
+	}
+}
+
+func TestAuditDeps(t *testing.T) {
+	uroot := &packages.Module{Path: "github.com/u-root/u-root", Dir: "/src/u-root", Main: true}
+	uio := &packages.Package{
+		PkgPath: "github.com/u-root/u-root/pkg/uio",
+		Module:  uroot,
+	}
+	dhcp := &packages.Package{
+		PkgPath: "github.com/insomniacslk/dhcp/dhcpv4",
+		Module:  &packages.Module{Path: "github.com/insomniacslk/dhcp", Version: "v1.0.0"},
+	}
+	unix := &packages.Package{
+		PkgPath: "golang.org/x/sys/unix",
+		Module:  &packages.Module{Path: "golang.org/x/sys", Version: "v0.1.0"},
+	}
+	local := &packages.Package{
+		PkgPath: "github.com/hugelgupf/p9/p9",
+		Module: &packages.Module{
+			Path:    "github.com/hugelgupf/p9",
+			Version: "v0.1.0",
+			Replace: &packages.Module{Path: "../p9"},
+		},
+	}
+	dhclient := &packages.Package{
+		PkgPath: "github.com/u-root/u-root/cmds/core/dhclient",
+		Module:  uroot,
+		Imports: map[string]*packages.Package{
+			dhcp.PkgPath:  dhcp,
+			unix.PkgPath:  unix,
+			uio.PkgPath:   uio,
+			local.PkgPath: local,
+		},
+	}
+	cmds := []*bbinternal.Package{{Name: "dhclient", Pkg: dhclient}}
+
+	got := auditDeps(cmds, map[string]string{
+		"github.com/insomniacslk/dhcp": "v1.2.0",
+		"golang.org/x/sys":             "v0.1.0",
+		"github.com/hugelgupf/p9":      "v0.3.0",
+	})
+	want := []*diag.DependencyUpgrade{
+		{
+			Cmd:      "github.com/u-root/u-root/cmds/core/dhclient",
+			Module:   "github.com/insomniacslk/dhcp",
+			Version:  "v1.0.0",
+			Selected: "v1.2.0",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("auditDeps() = %v, want %v", got, want)
+	}
+}
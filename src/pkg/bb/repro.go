@@ -0,0 +1,329 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/u-root/uio/cp"
+)
+
+// FileDiff is a generated source file that differs between two builds.
+type FileDiff struct {
+	// Path is the file path relative to the generated source directory.
+	Path string
+
+	// Line is the first differing line, or 0 if the file exists in only
+	// one of the builds.
+	Line int
+
+	// A and B are the differing lines, or "(missing)".
+	A, B string
+}
+
+func (d FileDiff) String() string {
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s vs %s", d.Path, d.A, d.B)
+	}
+	return fmt.Sprintf("%s:%d: %q vs %q", d.Path, d.Line, d.A, d.B)
+}
+
+// ErrNotReproducible is returned by VerifyReproducible if two builds of the
+// same busybox differ.
+type ErrNotReproducible struct {
+	// GenSrcDirs are the generated source directories of both builds.
+	GenSrcDirs [2]string
+
+	// Binaries are the binaries of both builds.
+	Binaries [2]string
+
+	// Packages are the Go import paths of generated packages whose
+	// source differs.
+	Packages []string
+
+	// Files are the differing generated source files.
+	Files []FileDiff
+
+	// Sections are the ELF sections of the binaries that differ, if the
+	// binaries are ELF files.
+	Sections []string
+}
+
+// Error implements error.Error.
+func (e *ErrNotReproducible) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "busybox build is not reproducible: %s and %s differ", e.Binaries[0], e.Binaries[1])
+	if len(e.Sections) > 0 {
+		fmt.Fprintf(&b, "\n\tdiffering sections: %s", strings.Join(e.Sections, ", "))
+	}
+	if len(e.Packages) > 0 {
+		fmt.Fprintf(&b, "\n\tdiffering generated packages: %s", strings.Join(e.Packages, ", "))
+	}
+	for _, f := range e.Files {
+		fmt.Fprintf(&b, "\n\t%s", f)
+	}
+	if len(e.Files) == 0 {
+		fmt.Fprintf(&b, "\n\tgenerated source in %s and %s is identical", e.GenSrcDirs[0], e.GenSrcDirs[1])
+	}
+	return b.String()
+}
+
+// ErrReproducibilityBuild is returned by VerifyReproducible if one of its
+// builds fails.
+type ErrReproducibilityBuild struct {
+	// Build is the number of the failed build, 1 or 2.
+	Build int
+
+	// GenSrcDirs are the generated source directories of all builds
+	// started so far, which are kept for debugging.
+	GenSrcDirs []string
+
+	Err error
+}
+
+// Unwrap implements error.Unwrap.
+func (e *ErrReproducibilityBuild) Unwrap() error {
+	return e.Err
+}
+
+// Error implements error.Error.
+func (e *ErrReproducibilityBuild) Error() string {
+	return fmt.Sprintf("reproducibility build %d failed (generated source kept in %s): %v", e.Build, strings.Join(e.GenSrcDirs, ", "), e.Err)
+}
+
+// VerifyReproducible builds the busybox described by opts twice and checks
+// that both binaries are identical.
+//
+// The builds use independent generated source directories at different
+// absolute paths, and the second build shuffles the order of
+// opts.CommandPaths. opts.GenSrcDir is ignored. If the binaries are identical,
+// one of them is written to opts.BinaryPath. Only the first build reports
+// diagnostics to opts.OnDiagnostic, since the second would repeat them.
+//
+// Otherwise, an *ErrNotReproducible describes which generated files and
+// binary sections differ, and both build directories are kept for debugging.
+// If a build fails, an *ErrReproducibilityBuild names the generated source
+// directories of all builds started so far, which are kept as well.
+func VerifyReproducible(opts *Opts) error {
+	if opts == nil {
+		return fmt.Errorf("no options given for busybox build")
+	}
+	if opts.GenerateOnly {
+		return fmt.Errorf("reproducibility can only be verified when building a binary")
+	}
+
+	var dirs, genDirs, bins [2]string
+	// Different prefix lengths make sure no absolute path makes it into
+	// the binary, even where only its length would.
+	for i, prefix := range []string{"bb-repro-a-", "bb-reproducible-b-"} {
+		dir, err := ioutil.TempDir("", prefix)
+		if err != nil {
+			for _, d := range dirs[:i] {
+				os.RemoveAll(d)
+			}
+			return err
+		}
+		dirs[i] = dir
+		genDirs[i] = filepath.Join(dir, "gen")
+		bins[i] = filepath.Join(dir, "bb")
+
+		o := *opts
+		o.GenSrcDir = genDirs[i]
+		o.BinaryPath = bins[i]
+		o.CommandPaths = append([]string(nil), opts.CommandPaths...)
+		if i == 1 {
+			o.OnDiagnostic = nil
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			r.Shuffle(len(o.CommandPaths), func(a, b int) {
+				o.CommandPaths[a], o.CommandPaths[b] = o.CommandPaths[b], o.CommandPaths[a]
+			})
+		}
+		log.Printf("Reproducibility build %d of 2 in %s", i+1, dir)
+		if err := BuildBusybox(&o); err != nil {
+			return &ErrReproducibilityBuild{
+				Build:      i + 1,
+				GenSrcDirs: append([]string(nil), genDirs[:i+1]...),
+				Err:        err,
+			}
+		}
+	}
+
+	a, err := ioutil.ReadFile(bins[0])
+	if err != nil {
+		return fmt.Errorf("%v (build directories kept: %s, %s)", err, dirs[0], dirs[1])
+	}
+	b, err := ioutil.ReadFile(bins[1])
+	if err != nil {
+		return fmt.Errorf("%v (build directories kept: %s, %s)", err, dirs[0], dirs[1])
+	}
+	if bytes.Equal(a, b) {
+		if opts.BinaryPath != "" {
+			if err := cp.Copy(bins[0], opts.BinaryPath); err != nil {
+				return err
+			}
+		}
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+		return nil
+	}
+
+	files, err := diffTrees(genDirs[0], genDirs[1])
+	if err != nil {
+		return fmt.Errorf("binaries %s and %s differ, and comparing generated source failed: %v", bins[0], bins[1], err)
+	}
+	return &ErrNotReproducible{
+		GenSrcDirs: genDirs,
+		Binaries:   bins,
+		Packages:   diffPackages(files),
+		Files:      files,
+		Sections:   diffSections(a, b),
+	}
+}
+
+// readTree returns the contents of all files under dir by path relative to
+// dir, with dir itself replaced by a placeholder.
+func readTree(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = bytes.Replace(data, []byte(dir), []byte("$GENSRCDIR"), -1)
+		return nil
+	})
+	return files, err
+}
+
+// diffTrees returns the files that differ between directories a and b.
+func diffTrees(a, b string) ([]FileDiff, error) {
+	filesA, err := readTree(a)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := readTree(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffFiles(filesA, filesB), nil
+}
+
+// diffFiles returns the first difference of each file that differs between
+// the file sets a and b, by path.
+func diffFiles(a, b map[string][]byte) []FileDiff {
+	paths := make(map[string]struct{})
+	for p := range a {
+		paths[p] = struct{}{}
+	}
+	for p := range b {
+		paths[p] = struct{}{}
+	}
+	var diffs []FileDiff
+	for _, p := range listStrings(paths) {
+		da, okA := a[p]
+		db, okB := b[p]
+		switch {
+		case !okA:
+			diffs = append(diffs, FileDiff{Path: p, A: "(missing)", B: "(present)"})
+		case !okB:
+			diffs = append(diffs, FileDiff{Path: p, A: "(present)", B: "(missing)"})
+		case !bytes.Equal(da, db):
+			diffs = append(diffs, firstDiff(p, da, db))
+		}
+	}
+	return diffs
+}
+
+// firstDiff returns the first line that differs between file contents a and
+// b.
+func firstDiff(path string, a, b []byte) FileDiff {
+	la := strings.Split(string(a), "\n")
+	lb := strings.Split(string(b), "\n")
+	for i := 0; ; i++ {
+		var sa, sb string
+		if i < len(la) {
+			sa = la[i]
+		} else {
+			sa = "(missing)"
+		}
+		if i < len(lb) {
+			sb = lb[i]
+		} else {
+			sb = "(missing)"
+		}
+		if sa != sb {
+			return FileDiff{Path: path, Line: i + 1, A: sa, B: sb}
+		}
+	}
+}
+
+// diffPackages returns the Go import paths of generated packages that
+// contain differing files.
+func diffPackages(files []FileDiff) []string {
+	pkgs := make(map[string]struct{})
+	for _, f := range files {
+		// Packages are generated at src/<import path>.
+		if strings.HasPrefix(f.Path, "src/") && strings.HasSuffix(f.Path, ".go") {
+			pkgs[strings.TrimPrefix(filepath.ToSlash(filepath.Dir(f.Path)), "src/")] = struct{}{}
+		}
+	}
+	return listStrings(pkgs)
+}
+
+// diffSections returns the names of ELF sections that differ between binaries
+// a and b, or nil if they are not ELF files.
+func diffSections(a, b []byte) []string {
+	ea, err := elf.NewFile(bytes.NewReader(a))
+	if err != nil {
+		return nil
+	}
+	eb, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	var diffs []string
+	for _, sa := range ea.Sections {
+		sb := eb.Section(sa.Name)
+		if sb == nil {
+			diffs = append(diffs, sa.Name+" (missing in second binary)")
+			continue
+		}
+		if sa.Type == elf.SHT_NOBITS {
+			if sa.Size != sb.Size {
+				diffs = append(diffs, sa.Name)
+			}
+			continue
+		}
+		da, errA := sa.Data()
+		db, errB := sb.Data()
+		if errA != nil || errB != nil || !bytes.Equal(da, db) {
+			diffs = append(diffs, sa.Name)
+		}
+	}
+	for _, sb := range eb.Sections {
+		if ea.Section(sb.Name) == nil {
+			diffs = append(diffs, sb.Name+" (missing in first binary)")
+		}
+	}
+	return diffs
+}
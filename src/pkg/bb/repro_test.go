@@ -0,0 +1,159 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bb-repro-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDiffTrees(t *testing.T) {
+	a := writeTree(t, map[string]string{
+		"src/bb.u-root.com/bb/main.go":  "package main\n\nimport (\n\t_ \"example.com/a\"\n\t_ \"example.com/b\"\n)\n",
+		"src/example.com/a/a.go":        "package a\n",
+		"src/example.com/b/b.go":        "package b\n",
+		"src/bb.u-root.com/bb/go.mod":   "module bb.u-root.com/bb\n",
+		"srcmap.json":                   "",
+		"src/example.com/onlya/only.go": "package onlya\n",
+	})
+	defer os.RemoveAll(a)
+	b := writeTree(t, map[string]string{
+		"src/bb.u-root.com/bb/main.go": "package main\n\nimport (\n\t_ \"example.com/b\"\n\t_ \"example.com/a\"\n)\n",
+		"src/example.com/a/a.go":       "package a\n",
+		"src/example.com/b/b.go":       "package b\n",
+		"src/bb.u-root.com/bb/go.mod":  "module bb.u-root.com/bb\n",
+		"srcmap.json":                  "",
+	})
+	defer os.RemoveAll(b)
+	// Paths of the generated source directory itself do not count.
+	if err := ioutil.WriteFile(filepath.Join(a, "srcmap.json"), []byte(a+"/src/example.com/a/a.go"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(b, "srcmap.json"), []byte(b+"/src/example.com/a/a.go"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := diffTrees(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FileDiff{
+		{Path: "src/bb.u-root.com/bb/main.go", Line: 4, A: "\t_ \"example.com/a\"", B: "\t_ \"example.com/b\""},
+		{Path: "src/example.com/onlya/only.go", A: "(present)", B: "(missing)"},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("diffTrees() = %v, want %v", files, want)
+	}
+	if got, want := diffPackages(files), []string{"bb.u-root.com/bb", "example.com/onlya"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("diffPackages() = %v, want %v", got, want)
+	}
+}
+
+func TestDiffSectionsNotELF(t *testing.T) {
+	if got := diffSections([]byte("a"), []byte("b")); got != nil {
+		t.Errorf("diffSections(non-ELF) = %v, want nil", got)
+	}
+}
+
+type elfSection struct {
+	name string
+	data string
+}
+
+// elfFile returns a minimal 64-bit little-endian ELF file with sections.
+func elfFile(t *testing.T, sections []elfSection) []byte {
+	t.Helper()
+	const hdrSize, shdrSize = 64, 64
+
+	// Section 0 is the null section, the last is the section name
+	// table.
+	shstrtab := []byte{0}
+	var names []uint32
+	for _, s := range append(sections, elfSection{name: ".shstrtab"}) {
+		names = append(names, uint32(len(shstrtab)))
+		shstrtab = append(append(shstrtab, s.name...), 0)
+	}
+
+	var body bytes.Buffer
+	shdrs := []elf.Section64{{}}
+	for i, s := range sections {
+		shdrs = append(shdrs, elf.Section64{
+			Name:      names[i],
+			Type:      uint32(elf.SHT_PROGBITS),
+			Off:       uint64(hdrSize + body.Len()),
+			Size:      uint64(len(s.data)),
+			Addralign: 1,
+		})
+		body.WriteString(s.data)
+	}
+	shdrs = append(shdrs, elf.Section64{
+		Name:      names[len(sections)],
+		Type:      uint32(elf.SHT_STRTAB),
+		Off:       uint64(hdrSize + body.Len()),
+		Size:      uint64(len(shstrtab)),
+		Addralign: 1,
+	})
+	body.Write(shstrtab)
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(hdrSize + body.Len()),
+		Ehsize:    hdrSize,
+		Shentsize: shdrSize,
+		Shnum:     uint16(len(shdrs)),
+		Shstrndx:  uint16(len(shdrs) - 1),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var f bytes.Buffer
+	for _, v := range []interface{}{hdr, body.Bytes(), shdrs} {
+		if err := binary.Write(&f, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f.Bytes()
+}
+
+func TestDiffSectionsELF(t *testing.T) {
+	a := elfFile(t, []elfSection{{".text", "code"}, {".data", "aaaa"}, {".note.a", "x"}})
+	b := elfFile(t, []elfSection{{".text", "code"}, {".data", "aaab"}, {".note.b", "x"}})
+	// The section name tables differ as well.
+	want := []string{".data", ".note.a (missing in second binary)", ".shstrtab", ".note.b (missing in first binary)"}
+	if got := diffSections(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSections() = %v, want %v", got, want)
+	}
+	if got := diffSections(a, a); got != nil {
+		t.Errorf("diffSections(a, a) = %v, want nil", got)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rewrite turns a Go command into a library package that registers
+// the command with bbmain, the transformation busyboxes are built from.
+//
+// The package keeps its API stable, unlike bbinternal, and is meant for build
+// systems that orchestrate busybox builds themselves:
+//
+//	pkgs, err := packages.Load(&packages.Config{Mode: rewrite.LoadMode}, "example.com/cmd/ls")
+//	...
+//	res, err := rewrite.Rewrite(pkgs[0], rewrite.RewriteOptions{
+//		Output: rewrite.Dir("gen/ls"),
+//	})
+//
+// Build systems that generate the rest of the busybox into a genfs.FS can
+// write the rewritten package into the same file system instead:
+//
+//	res, err := rewrite.Rewrite(pkgs[0], rewrite.RewriteOptions{
+//		FS:  fsys,
+//		Dir: "gen/ls",
+//	})
+//
+// The generated package is named bb<command name>. Importing it runs an init
+// function that registers the command with bbmain under its name; bbmain then
+// runs the command's initialization (Result.InitFunc) and main function
+// (Result.MainFunc) when the busybox is invoked as that command.
+package rewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/bb/genfs"
+)
+
+// DefaultBBMainImportPath is the import path of bbmain in this repository.
+const DefaultBBMainImportPath = "github.com/u-root/gobusybox/src/pkg/bb/bbmain"
+
+// LoadMode is the packages.LoadMode that commands passed to Rewrite must at
+// least be loaded with.
+const LoadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedModule
+
+// Writer receives the files of a rewritten package.
+type Writer interface {
+	// WriteFile writes the file name, a base name, with data.
+	WriteFile(name string, data []byte) error
+}
+
+// Dir is a Writer that writes files into the directory it names, which is
+// created if it does not exist.
+type Dir string
+
+// WriteFile implements Writer.
+func (d Dir) WriteFile(name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(string(d), name), data, 0644)
+}
+
+// RewriteOptions configure Rewrite.
+type RewriteOptions struct {
+	// Name is the name the command registers with bbmain. It defaults to
+	// the last element of the package's import path.
+	Name string
+
+	// BBMainImportPath is the import path of the bbmain package the
+	// command registers with. It defaults to DefaultBBMainImportPath.
+	BBMainImportPath string
+
+	// Output receives the rewritten files. Exactly one of Output and FS
+	// must be set.
+	Output Writer
+
+	// FS, if set, receives the rewritten files in the directory Dir,
+	// which is created if it does not exist. Files keep the permission
+	// bits of the command's files.
+	FS genfs.FS
+
+	// Dir is the directory in FS the rewritten files are written to.
+	Dir string
+
+	// GoVersion is the Go language version, e.g. go1.22, the rewritten
+	// package will be compiled with, if it differs from the version of
+	// the command's own module. Files whose loops would behave
+	// differently then get a //go:build constraint that keeps their
+	// module's language version.
+	GoVersion string
+}
+
+// Result describes a rewritten command.
+type Result struct {
+	// Name is the name the command registers with bbmain.
+	Name string
+
+	// PackageName is the name of the generated library package.
+	PackageName string
+
+	// InitFunc is the name of the generated function that runs the
+	// command's package variable initializations and init functions.
+	InitFunc string
+
+	// MainFunc is the name the command's main function was renamed to.
+	MainFunc string
+
+	// Files are the base names of the written files, sorted.
+	Files []string
+}
+
+// Rewrite rewrites the command pkg, loaded with at least LoadMode, into a
+// library package and writes its files to opts.Output or opts.FS.
+//
+// Rewrite modifies pkg.Syntax, so pkg cannot be rewritten again.
+func Rewrite(pkg *packages.Package, opts RewriteOptions) (*Result, error) {
+	if (opts.Output == nil) == (opts.FS == nil) {
+		return nil, fmt.Errorf("rewrite: exactly one of Output and FS must be given")
+	}
+	if pkg.Fset == nil || len(pkg.Syntax) == 0 || pkg.Types == nil || pkg.TypesInfo == nil {
+		return nil, fmt.Errorf("rewrite: package %q must be loaded with syntax and type information", pkg.PkgPath)
+	}
+	name := opts.Name
+	if name == "" {
+		name = path.Base(pkg.PkgPath)
+	}
+	bbImportPath := opts.BBMainImportPath
+	if bbImportPath == "" {
+		bbImportPath = DefaultBBMainImportPath
+	}
+
+	p := bbinternal.NewPackage(name, pkg)
+	if err := p.RewriteSyntax(bbImportPath); err != nil {
+		return nil, err
+	}
+	files, err := bbinternal.RenderPkg(pkg, "", &bbinternal.Output{GoVersion: opts.GoVersion})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{
+		Name:        p.Name,
+		PackageName: pkg.Syntax[0].Name.Name,
+		InitFunc:    p.InitFuncName(),
+		MainFunc:    p.MainFuncName(),
+	}
+	for name := range files {
+		res.Files = append(res.Files, name)
+	}
+	sort.Strings(res.Files)
+	if opts.FS != nil {
+		if err := opts.FS.MkdirAll(opts.Dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range res.Files {
+		var err error
+		if opts.FS != nil {
+			err = opts.FS.WriteFile(filepath.Join(opts.Dir, name), files[name].Data, files[name].Perm)
+		} else {
+			err = opts.Output.WriteFile(name, files[name].Data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rewrite
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/genfs"
+	"github.com/u-root/gobusybox/src/pkg/monoimporter"
+)
+
+// files is a Writer that keeps files in memory.
+type files map[string]string
+
+func (f files) WriteFile(name string, data []byte) error {
+	f[name] = string(data)
+	return nil
+}
+
+// load type-checks the command in srcs, by file name, as go/packages would
+// with LoadMode.
+func load(t *testing.T, pkgPath string, srcs map[string]string) *packages.Package {
+	t.Helper()
+	p := &packages.Package{
+		PkgPath: pkgPath,
+		Fset:    token.NewFileSet(),
+		TypesInfo: &types.Info{
+			Types:  make(map[ast.Expr]types.TypeAndValue),
+			Defs:   make(map[*ast.Ident]types.Object),
+			Uses:   make(map[*ast.Ident]types.Object),
+			Scopes: make(map[ast.Node]*types.Scope),
+		},
+	}
+	for _, name := range []string{"main.go", "util.go"} {
+		src, ok := srcs[name]
+		if !ok {
+			continue
+		}
+		f, err := parser.ParseFile(p.Fset, "/src/"+name, src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Syntax = append(p.Syntax, f)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(p.Fset, "source", nil)}
+	tpkg, err := conf.Check(pkgPath, p.Fset, p.Syntax, p.TypesInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Types = tpkg
+	p.Name = tpkg.Name()
+	return p
+}
+
+var helloSrcs = map[string]string{
+	"main.go": `package main
+
+import "fmt"
+
+var greeting = fmt.Sprint("hello")
+
+func main() {
+	fmt.Println(greeting)
+}
+`,
+	"util.go": `package main
+
+func init() {
+	greeting += "!"
+}
+`,
+}
+
+func TestRewrite(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		opts         RewriteOptions
+		want         Result
+		wantRegister string
+	}{
+		{
+			name: "defaults",
+			want: Result{
+				Name:        "hello",
+				PackageName: "bbhello",
+				InitFunc:    "registeredInit",
+				MainFunc:    "registeredMain",
+				Files:       []string{"main.go", "util.go"},
+			},
+			wantRegister: `bbmain "github.com/u-root/gobusybox/src/pkg/bb/bbmain"`,
+		},
+		{
+			name: "options",
+			opts: RewriteOptions{
+				Name:             "hi-there",
+				BBMainImportPath: "bb.u-root.com/bb/pkg/bbmain",
+			},
+			want: Result{
+				Name:        "hi-there",
+				PackageName: "bbhithere",
+				InitFunc:    "registeredInit",
+				MainFunc:    "registeredMain",
+				Files:       []string{"main.go", "util.go"},
+			},
+			wantRegister: `bbmain "bb.u-root.com/bb/pkg/bbmain"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := make(files)
+			tt.opts.Output = out
+			got, err := Rewrite(load(t, "example.com/cmd/hello", helloSrcs), tt.opts)
+			if err != nil {
+				t.Fatalf("Rewrite() = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Rewrite() = %+v, want %+v", *got, tt.want)
+			}
+			if len(out) != len(tt.want.Files) {
+				t.Errorf("Rewrite() wrote %d files, want %d", len(out), len(tt.want.Files))
+			}
+
+			main := out["main.go"]
+			for _, want := range []string{
+				"package " + tt.want.PackageName + "\n",
+				tt.wantRegister,
+				`bbmain.Register("` + tt.want.Name + `", ` + tt.want.InitFunc + `, ` + tt.want.MainFunc + `)`,
+				"func " + tt.want.MainFunc + "() {",
+				"func " + tt.want.InitFunc + "() {",
+			} {
+				if !strings.Contains(main, want) {
+					t.Errorf("main.go does not contain %q:\n%s", want, main)
+				}
+			}
+			if !strings.HasPrefix(out["util.go"], "package "+tt.want.PackageName+"\n") {
+				t.Errorf("util.go has the wrong package name:\n%s", out["util.go"])
+			}
+		})
+	}
+}
+
+// TestRewriteDeclsOnly rewrites a command loaded as rewritepkg and the Bazel
+// rules load it, which records no Defs.
+func TestRewriteDeclsOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "main.go")
+	if err := ioutil.WriteFile(path, []byte(`package main
+
+import (
+	"fmt"
+	"os"
+)
+
+var user = os.Getenv("USER")
+
+var host, hostErr = os.Hostname()
+
+var home, nargs = os.Getenv("HOME"), len(os.Args)
+
+func main() {
+	fmt.Println(user, host, hostErr, home, nargs)
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := monoimporter.Load("example.com/cmd/hello", []string{path}, importer.ForCompiler(token.NewFileSet(), "source", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(files)
+	if _, err := Rewrite(p, RewriteOptions{Output: out}); err != nil {
+		t.Fatalf("Rewrite() = %v", err)
+	}
+	for _, want := range []string{
+		"var user string\n",
+		"host    string\n\thostErr error\n",
+		"home  string\n\tnargs int\n",
+		"host, hostErr = os.Hostname()",
+	} {
+		if !strings.Contains(out["main.go"], want) {
+			t.Errorf("main.go does not contain %q:\n%s", want, out["main.go"])
+		}
+	}
+}
+
+func TestRewriteFS(t *testing.T) {
+	var fsys genfs.Mem
+	got, err := Rewrite(load(t, "example.com/cmd/hello", helloSrcs), RewriteOptions{FS: &fsys, Dir: "/gen/hello"})
+	if err != nil {
+		t.Fatalf("Rewrite() = %v", err)
+	}
+	if want := []string{"main.go", "util.go"}; !reflect.DeepEqual(got.Files, want) {
+		t.Errorf("Rewrite() files = %v, want %v", got.Files, want)
+	}
+	if dirs, want := fsys.Dirs(), []string{"/gen", "/gen/hello"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("Rewrite() created directories %v, want %v", dirs, want)
+	}
+	written := fsys.Files()
+	if len(written) != len(got.Files) {
+		t.Errorf("Rewrite() wrote %d files, want %d", len(written), len(got.Files))
+	}
+	for _, name := range got.Files {
+		f, ok := written["/gen/hello/"+name]
+		if !ok {
+			t.Errorf("Rewrite() did not write %s", name)
+			continue
+		}
+		if !strings.HasPrefix(string(f.Data), "package bbhello\n") {
+			t.Errorf("%s has the wrong package name:\n%s", name, f.Data)
+		}
+		if f.Perm != 0644 {
+			t.Errorf("%s has permissions %v, want %v", name, f.Perm, 0644)
+		}
+	}
+}
+
+func TestRewriteErrors(t *testing.T) {
+	p := load(t, "example.com/cmd/hello", helloSrcs)
+	if _, err := Rewrite(p, RewriteOptions{}); err == nil {
+		t.Errorf("Rewrite() without Output = nil, want error")
+	}
+	if _, err := Rewrite(p, RewriteOptions{Output: make(files), FS: &genfs.Mem{}}); err == nil {
+		t.Errorf("Rewrite() with Output and FS = nil, want error")
+	}
+	if _, err := Rewrite(&packages.Package{PkgPath: "example.com/cmd/hello"}, RewriteOptions{Output: make(files)}); err == nil {
+		t.Errorf("Rewrite() of package without syntax = nil, want error")
+	}
+
+	nomain := load(t, "example.com/cmd/nomain", map[string]string{"util.go": "package main\n\nfunc f() {}\n"})
+	if _, err := Rewrite(nomain, RewriteOptions{Output: make(files)}); err == nil {
+		t.Errorf("Rewrite() of package without main = nil, want error")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package srcmap maps lines of generated busybox source files back to the
+// original command source files they were rewritten from.
+//
+// Rewriting a command appends init functions, renames the package and adds
+// imports, so line numbers in the generated tree do not match the user's
+// files. A Map records, per generated file, which ranges of lines came from
+// which original file and line.
+package srcmap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Segment maps the generated lines starting at GenLine, up to the next
+// Segment's GenLine, to original lines starting at Line in File.
+//
+// An empty File means the lines were generated and have no original source.
+type Segment struct {
+	GenLine int    `json:"gen_line"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// Map maps generated file paths to their line segments.
+//
+// The zero value is not usable; use New.
+type Map struct {
+	// Files maps an absolute generated file path to its segments, sorted
+	// by GenLine.
+	Files map[string][]Segment `json:"files"`
+}
+
+// New returns an empty Map.
+func New() *Map {
+	return &Map{Files: make(map[string][]Segment)}
+}
+
+// Add records segments for the generated file genFile.
+func (m *Map) Add(genFile string, segments []Segment) {
+	s := append([]Segment(nil), segments...)
+	sort.SliceStable(s, func(i, j int) bool { return s[i].GenLine < s[j].GenLine })
+	m.Files[filepath.Clean(genFile)] = s
+}
+
+// Lookup returns the original file and line of line in the generated file
+// genFile.
+//
+// ok is false if genFile is unknown or the line was generated.
+func (m *Map) Lookup(genFile string, line int) (file string, origLine int, ok bool) {
+	if m == nil {
+		return "", 0, false
+	}
+	segments := m.Files[filepath.Clean(genFile)]
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].GenLine > line }) - 1
+	if i < 0 || segments[i].File == "" {
+		return "", 0, false
+	}
+	return segments[i].File, segments[i].Line + line - segments[i].GenLine, true
+}
+
+// goPos matches file:line positions of Go files as printed by the go command,
+// the compiler, and runtime stack traces.
+var goPos = regexp.MustCompile(`([^\s:"'()]+\.go):([0-9]+)`)
+
+// Translate replaces all positions in generated files in s with their
+// original positions. Relative file names are resolved relative to dir, which
+// should be the directory the go command ran in.
+//
+// Positions that are not in m are left alone.
+func (m *Map) Translate(dir, s string) string {
+	if m == nil || len(m.Files) == 0 {
+		return s
+	}
+	return goPos.ReplaceAllStringFunc(s, func(pos string) string {
+		sub := goPos.FindStringSubmatch(pos)
+		genFile := sub[1]
+		if !filepath.IsAbs(genFile) {
+			genFile = filepath.Join(dir, genFile)
+		}
+		line, err := strconv.Atoi(sub[2])
+		if err != nil {
+			return pos
+		}
+		if file, origLine, ok := m.Lookup(genFile, line); ok {
+			return file + ":" + strconv.Itoa(origLine)
+		}
+		return pos
+	})
+}
+
+// JSON returns m as the JSON WriteFile writes.
+func (m *Map) JSON() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// WriteFile writes m as JSON to path.
+func (m *Map) WriteFile(path string) error {
+	b, err := m.JSON()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// ReadFile reads a Map written by WriteFile.
+func ReadFile(path string) (*Map, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := New()
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
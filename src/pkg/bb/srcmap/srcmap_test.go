@@ -0,0 +1,72 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srcmap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	m := New()
+	m.Add("/tmp/bb-1/src/example.com/cmd/ls/ls.go", []Segment{
+		{GenLine: 1, File: "/home/me/cmd/ls/ls.go", Line: 1},
+		{GenLine: 12, File: "/home/me/cmd/ls/ls.go", Line: 10},
+		{GenLine: 30},
+	})
+
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "../example.com/cmd/ls/ls.go:5:2: undefined: foo",
+			want: "/home/me/cmd/ls/ls.go:5:2: undefined: foo",
+		},
+		{
+			in:   "/tmp/bb-1/src/example.com/cmd/ls/ls.go:14 +0x3b",
+			want: "/home/me/cmd/ls/ls.go:12 +0x3b",
+		},
+		{
+			// Generated code stays as is.
+			in:   "../example.com/cmd/ls/ls.go:31:1: oops",
+			want: "../example.com/cmd/ls/ls.go:31:1: oops",
+		},
+		{
+			// Unknown files stay as is.
+			in:   "./main.go:3:1: oops",
+			want: "./main.go:3:1: oops",
+		},
+	} {
+		if got := m.Translate("/tmp/bb-1/src/bb.u-root.com", tt.in); got != tt.want {
+			t.Errorf("Translate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	m := New()
+	m.Add("/gen/a.go", []Segment{{GenLine: 1, File: "/orig/a.go", Line: 1}})
+
+	dir, err := ioutil.TempDir("", "srcmap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "srcmap.json")
+	if err := m.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file, line, ok := got.Lookup("/gen/a.go", 7); !ok || file != "/orig/a.go" || line != 7 {
+		t.Errorf("Lookup(/gen/a.go, 7) = %s, %d, %t, want /orig/a.go, 7, true", file, line, ok)
+	}
+}
@@ -12,18 +12,86 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/u-root/gobusybox/src/pkg/uflag"
 )
 
 // Environ are the environment variables for the Go compiler.
+//
+// Default returns the environment the process was started with; LoadEnviron
+// returns the complete environment reported by `go env`. Either can then be
+// overridden field by field. See `go help environment` for the meaning of
+// each variable.
 type Environ struct {
 	build.Context
 
 	GO111MODULE string
+
+	// GOTOOLCHAIN selects the Go toolchain used for builds, e.g. local,
+	// auto or go1.22.3. See https://go.dev/doc/toolchain.
+	GOTOOLCHAIN string
+
+	// GOFLAGS are flags applied to every go command. -ldflags in GOFLAGS
+	// are merged with BuildOpts' linker flags.
+	GOFLAGS string
+
+	// GOEXPERIMENT enables toolchain experiments.
+	GOEXPERIMENT string
+
+	// Architecture-specific settings, e.g. GOAMD64=v3 or GOARM=7.
+	GOAMD64   string
+	GOARM     string
+	GOARM64   string
+	GO386     string
+	GOMIPS    string
+	GOMIPS64  string
+	GOPPC64   string
+	GORISCV64 string
+
+	// Module download settings.
+	GOPROXY    string
+	GOPRIVATE  string
+	GONOPROXY  string
+	GONOSUMDB  string
+	GOSUMDB    string
+	GOINSECURE string
+	GOMODCACHE string
+
+	// GOCACHE is the build cache directory.
+	GOCACHE string
+
+	// GOWORK selects a go.work file, or "off".
+	GOWORK string
+
+	// GOENV is the go environment configuration file, or "off".
+	GOENV string
+
+	// Extra are additional environment variables for go commands as
+	// KEY=VALUE, e.g. CC=clang or GODEBUG=x=1. They are passed in sorted
+	// order.
+	Extra []string
+
+	// Hermetic runs go commands with only the variables in this Environ,
+	// instead of adding them to the process environment.
+	//
+	// A hermetic Environ should be based on LoadEnviron, so that GOCACHE
+	// and GOPATH are set. GOENV is "off" unless set, so that the user's
+	// go env file is not used either.
+	Hermetic bool
+
+	// HermeticPATH is the PATH of hermetic go commands, after
+	// $GOROOT/bin. The go command runs programs from it, e.g. git to
+	// download modules or gcc for cgo. If empty, DefaultHermeticPATH is
+	// used.
+	HermeticPATH string
 }
 
+// DefaultHermeticPATH is the PATH of hermetic go commands if
+// Environ.HermeticPATH is not set.
+const DefaultHermeticPATH = "/usr/local/bin:/usr/bin:/bin"
+
 // Valid returns an error if GOARCH, GOROOT, or GOOS are unset.
 func (c Environ) Valid() error {
 	if c.GOARCH == "" && c.GOROOT == "" && c.GOOS == "" {
@@ -42,21 +110,48 @@ func (c Environ) Valid() error {
 }
 
 // Default is the default build environment comprised of the default GOPATH,
-// GOROOT, GOOS, GOARCH, and CGO_ENABLED values.
+// GOROOT, GOOS, GOARCH, and CGO_ENABLED values, and all other Environ
+// variables as set in the process environment.
 func Default() Environ {
-	return Environ{
+	c := Environ{
 		Context:     build.Default,
 		GO111MODULE: os.Getenv("GO111MODULE"),
 	}
+	for _, f := range c.fields() {
+		*f.value = os.Getenv(f.key)
+	}
+	return c
+}
+
+// Toolchain returns the specific toolchain GOTOOLCHAIN asks for, e.g.
+// go1.22.3 for GOTOOLCHAIN=go1.22.3+auto, or "" if it names none.
+func (c Environ) Toolchain() string {
+	tc := c.GOTOOLCHAIN
+	if i := strings.Index(tc, "+"); i >= 0 {
+		tc = tc[:i]
+	}
+	if !strings.HasPrefix(tc, "go1") {
+		return ""
+	}
+	return tc
 }
 
 // GoCmd runs a go command in the environment.
 func (c Environ) GoCmd(args ...string) *exec.Cmd {
 	cmd := exec.Command(filepath.Join(c.GOROOT, "bin", "go"), args...)
-	cmd.Env = append(os.Environ(), c.Env()...)
+	cmd.Env = c.CmdEnv()
 	return cmd
 }
 
+// CmdEnv returns the complete environment for a go command: the process
+// environment with Env applied, or only Env if c is Hermetic.
+func (c Environ) CmdEnv() []string {
+	if c.Hermetic {
+		return c.Env()
+	}
+	return append(os.Environ(), c.Env()...)
+}
+
 // Version returns the Go version string that runtime.Version would return for
 // the Go compiler in this environ.
 func (c Environ) Version() (string, error) {
@@ -89,6 +184,17 @@ func (c Environ) envCommon() []string {
 	}
 	env = append(env, fmt.Sprintf("CGO_ENABLED=%d", cgo))
 	env = append(env, fmt.Sprintf("GO111MODULE=%s", c.GO111MODULE))
+	for _, f := range c.fields() {
+		if *f.value != "" {
+			env = append(env, fmt.Sprintf("%s=%s", f.key, *f.value))
+		}
+	}
+	if c.Hermetic && c.GOENV == "" {
+		env = append(env, "GOENV=off")
+	}
+	extra := append([]string(nil), c.Extra...)
+	sort.Strings(extra)
+	env = append(env, extra...)
 
 	if c.GOROOT != "" {
 		env = append(env, fmt.Sprintf("GOROOT=%s", c.GOROOT))
@@ -98,20 +204,40 @@ func (c Environ) envCommon() []string {
 
 func (c Environ) EnvHuman() []string {
 	env := c.envCommon()
+	path := "$PATH"
+	if c.Hermetic {
+		path = c.hermeticPATH()
+	}
 	if c.GOROOT != "" {
-		env = append(env, fmt.Sprintf("PATH=%s:$PATH", filepath.Join(c.GOROOT, "bin")))
+		env = append(env, fmt.Sprintf("PATH=%s:%s", filepath.Join(c.GOROOT, "bin"), path))
+	} else if c.Hermetic {
+		env = append(env, fmt.Sprintf("PATH=%s", path))
 	}
 	return env
 }
 
+// hermeticPATH returns the PATH of hermetic go commands, after $GOROOT/bin.
+func (c Environ) hermeticPATH() string {
+	if c.HermeticPATH == "" {
+		return DefaultHermeticPATH
+	}
+	return c.HermeticPATH
+}
+
 // Env returns all environment variables for invoking a Go command.
 func (c Environ) Env() []string {
 	env := c.envCommon()
+	path := os.Getenv("PATH")
+	if c.Hermetic {
+		path = c.hermeticPATH()
+	}
 	if c.GOROOT != "" {
 		// If GOROOT is set to a different version of Go, we must
 		// ensure that $GOROOT/bin is also in path to make the "go"
 		// binary available to golang.org/x/tools/packages.
-		env = append(env, fmt.Sprintf("PATH=%s:%s", filepath.Join(c.GOROOT, "bin"), os.Getenv("PATH")))
+		env = append(env, fmt.Sprintf("PATH=%s:%s", filepath.Join(c.GOROOT, "bin"), path))
+	} else if c.Hermetic {
+		env = append(env, fmt.Sprintf("PATH=%s", path))
 	}
 	return env
 }
@@ -142,7 +268,14 @@ type BuildOpts struct {
 	NoTrimPath bool
 
 	// ExtraArgs to `go build`.
+	//
+	// -ldflags given here are merged with the default linker flags and
+	// LDFlags rather than replacing them.
 	ExtraArgs []string
+
+	// LDFlags are additional linker flags, e.g. []string{"-X",
+	// "example.com/foo.version=1.0"}, appended to the defaults.
+	LDFlags []string
 }
 
 // RegisterFlags registers flags for BuildOpts.
@@ -150,8 +283,7 @@ func (b *BuildOpts) RegisterFlags(f *flag.FlagSet) {
 	f.BoolVar(&b.NoStrip, "go-no-strip", false, "Do not strip symbols & Build ID from the binary (will not produce a reproducible binary)")
 	f.BoolVar(&b.EnableInlining, "go-enable-inlining", false, "Enable inlining (will likely produce a larger binary)")
 	f.BoolVar(&b.NoTrimPath, "go-no-trimpath", false, "Disable -trimpath (will not produce a reproducible binary)")
-	arg := uflag.Strings(b.ExtraArgs)
-	f.Var(&arg, "go-extra-args", "Extra args to `go build`")
+	f.Var((*uflag.Strings)(&b.ExtraArgs), "go-extra-args", "Extra args to `go build` (may be repeated)")
 }
 
 // BuildDir compiles the package in the directory `dirPath`, writing the build
@@ -172,9 +304,30 @@ func (c Environ) BuildDir(dirPath string, binaryPath string, opts *BuildOpts) er
 		// Disable "function inlining" to get a (likely) smaller binary.
 		args = append(args, "-gcflags=all=-l")
 	}
+	var ldflags []string
 	if !opts.NoStrip {
 		// Strip all symbols, and don't embed a Go build ID to be reproducible.
-		args = append(args, "-ldflags", "-s -w -buildid=")
+		ldflags = append(ldflags, "-s", "-w", "-buildid=")
+	}
+	// -ldflags on the command line override those in GOFLAGS and each
+	// other, so merge them all into one.
+	goflagsLD, _, err := SplitLDFlags(strings.Fields(c.GOFLAGS))
+	if err != nil {
+		return fmt.Errorf("invalid -ldflags in GOFLAGS: %v", err)
+	}
+	extraLD, extraArgs, err := SplitLDFlags(opts.ExtraArgs)
+	if err != nil {
+		return fmt.Errorf("invalid -ldflags in extra args: %v", err)
+	}
+	ldflags = append(ldflags, goflagsLD...)
+	ldflags = append(ldflags, extraLD...)
+	ldflags = append(ldflags, opts.LDFlags...)
+	if len(ldflags) > 0 {
+		ld, err := JoinQuoted(ldflags)
+		if err != nil {
+			return fmt.Errorf("invalid linker flags: %v", err)
+		}
+		args = append(args, "-ldflags", ld)
 	}
 	if !opts.NoTrimPath {
 		// Reproducible builds: Trim any GOPATHs out of the executable's
@@ -187,6 +340,7 @@ func (c Environ) BuildDir(dirPath string, binaryPath string, opts *BuildOpts) er
 	if len(c.BuildTags) > 0 {
 		args = append(args, []string{"-tags", strings.Join(c.BuildTags, " ")}...)
 	}
+	args = append(args, extraArgs...)
 	// We always set the working directory, so this is always '.'.
 	args = append(args, ".")
 
@@ -198,3 +352,86 @@ func (c Environ) BuildDir(dirPath string, binaryPath string, opts *BuildOpts) er
 	}
 	return nil
 }
+
+// SplitLDFlags splits the values of all -ldflags flags in the `go build`
+// arguments args into separate linker flags, and returns them and the
+// remaining arguments.
+func SplitLDFlags(args []string) (ldflags []string, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		var value string
+		if !strings.HasPrefix(args[i], "-") {
+			rest = append(rest, args[i])
+			continue
+		} else if name == "ldflags" {
+			if i+1 == len(args) {
+				return nil, nil, fmt.Errorf("-ldflags needs an argument")
+			}
+			value = args[i+1]
+			i++
+		} else if strings.HasPrefix(name, "ldflags=") {
+			value = strings.TrimPrefix(name, "ldflags=")
+		} else {
+			rest = append(rest, args[i])
+			continue
+		}
+		f, err := SplitQuoted(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		ldflags = append(ldflags, f...)
+	}
+	return ldflags, rest, nil
+}
+
+// SplitQuoted splits s into space-separated fields, which may be quoted
+// with single or double quotes, the way the go command splits -ldflags.
+func SplitQuoted(s string) ([]string, error) {
+	var f []string
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t\n\r")
+		if s == "" {
+			break
+		}
+		if s[0] == '"' || s[0] == '\'' {
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %c string", s[0])
+			}
+			f = append(f, s[1:end+1])
+			s = s[end+2:]
+			continue
+		}
+		end := strings.IndexAny(s, " \t\n\r")
+		if end < 0 {
+			end = len(s)
+		}
+		f = append(f, s[:end])
+		s = s[end:]
+	}
+	return f, nil
+}
+
+// JoinQuoted joins fields into a string that SplitQuoted splits into fields
+// again.
+//
+// Quotes cannot be escaped, so fields containing both single and double
+// quotes are an error.
+func JoinQuoted(fields []string) (string, error) {
+	var q []string
+	for _, f := range fields {
+		switch {
+		case f == "":
+			q = append(q, "''")
+		case !strings.ContainsAny(f, " \t\n\r'\""):
+			q = append(q, f)
+		case !strings.Contains(f, "'"):
+			q = append(q, "'"+f+"'")
+		case !strings.Contains(f, "\""):
+			q = append(q, "\""+f+"\"")
+		default:
+			return "", fmt.Errorf("%q contains both single and double quotes", f)
+		}
+	}
+	return strings.Join(q, " "), nil
+}
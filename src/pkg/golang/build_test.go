@@ -0,0 +1,57 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package golang
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitLDFlags(t *testing.T) {
+	ldflags, rest, err := SplitLDFlags([]string{"-tags", "netgo", "-ldflags", "-X 'main.name=a b'", "--ldflags=-extldflags=-static", "-v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-X", "main.name=a b", "-extldflags=-static"}; !reflect.DeepEqual(ldflags, want) {
+		t.Errorf("ldflags = %q, want %q", ldflags, want)
+	}
+	if want := []string{"-tags", "netgo", "-v"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("rest = %q, want %q", rest, want)
+	}
+
+	if _, _, err := SplitLDFlags([]string{"-ldflags"}); err == nil {
+		t.Errorf("SplitLDFlags(-ldflags without value) = nil, want error")
+	}
+	if _, _, err := SplitLDFlags([]string{"-ldflags", "-X 'main.name=a"}); err == nil {
+		t.Errorf("SplitLDFlags(unterminated quote) = nil, want error")
+	}
+}
+
+func TestJoinQuoted(t *testing.T) {
+	for _, fields := range [][]string{
+		{"-s", "-w", "-buildid="},
+		{"-X", "main.name=a b", ""},
+		{"-X", "main.quote=it's"},
+		{"-X", `main.quote="quoted"`},
+	} {
+		joined, err := JoinQuoted(fields)
+		if err != nil {
+			t.Errorf("JoinQuoted(%q) = %v", fields, err)
+			continue
+		}
+		got, err := SplitQuoted(joined)
+		if err != nil {
+			t.Errorf("SplitQuoted(JoinQuoted(%q)) = %v", fields, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, fields) {
+			t.Errorf("SplitQuoted(JoinQuoted(%q)) = %q", fields, got)
+		}
+	}
+
+	if _, err := JoinQuoted([]string{"-X", `main.quote="it's"`}); err == nil {
+		t.Errorf("JoinQuoted(field with both quotes) = nil, want error")
+	}
+}
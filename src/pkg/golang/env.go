@@ -0,0 +1,95 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package golang
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// envField is an environment variable modelled by an Environ field.
+type envField struct {
+	key   string
+	value *string
+}
+
+// fields returns the environment variables modelled by c's string fields,
+// except for those of build.Context and GO111MODULE.
+func (c *Environ) fields() []envField {
+	return []envField{
+		{"GOTOOLCHAIN", &c.GOTOOLCHAIN},
+		{"GOFLAGS", &c.GOFLAGS},
+		{"GOEXPERIMENT", &c.GOEXPERIMENT},
+		{"GOAMD64", &c.GOAMD64},
+		{"GOARM", &c.GOARM},
+		{"GOARM64", &c.GOARM64},
+		{"GO386", &c.GO386},
+		{"GOMIPS", &c.GOMIPS},
+		{"GOMIPS64", &c.GOMIPS64},
+		{"GOPPC64", &c.GOPPC64},
+		{"GORISCV64", &c.GORISCV64},
+		{"GOPROXY", &c.GOPROXY},
+		{"GOPRIVATE", &c.GOPRIVATE},
+		{"GONOPROXY", &c.GONOPROXY},
+		{"GONOSUMDB", &c.GONOSUMDB},
+		{"GOSUMDB", &c.GOSUMDB},
+		{"GOINSECURE", &c.GOINSECURE},
+		{"GOMODCACHE", &c.GOMODCACHE},
+		{"GOCACHE", &c.GOCACHE},
+		{"GOWORK", &c.GOWORK},
+		{"GOENV", &c.GOENV},
+	}
+}
+
+// environFromGoEnv returns the Environ described by the output of `go env
+// -json`.
+func environFromGoEnv(vars map[string]string) Environ {
+	c := Environ{Context: build.Default}
+	c.GOARCH = vars["GOARCH"]
+	c.GOOS = vars["GOOS"]
+	c.GOROOT = vars["GOROOT"]
+	c.GOPATH = vars["GOPATH"]
+	c.CgoEnabled = vars["CGO_ENABLED"] == "1"
+	c.GO111MODULE = vars["GO111MODULE"]
+	for _, f := range c.fields() {
+		*f.value = vars[f.key]
+	}
+	return c
+}
+
+// LoadEnviron returns the complete environment reported by `go env -json`
+// for the go command in goroot, or the go command in $PATH if goroot is
+// empty.
+//
+// Unlike Default, it reflects the user's go env file and the toolchain's
+// defaults, e.g. for GOPROXY and GOCACHE. Fields may be overridden before
+// use, and Hermetic may be set to stop inheriting the process environment.
+func LoadEnviron(goroot string) (Environ, error) {
+	gobin := "go"
+	if goroot != "" {
+		gobin = filepath.Join(goroot, "bin", "go")
+	}
+	cmd := exec.Command(gobin, "env", "-json")
+	cmd.Env = os.Environ()
+	if goroot != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GOROOT=%s", goroot))
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return Environ{}, fmt.Errorf("go env -json failed: %v: %s", err, ee.Stderr)
+		}
+		return Environ{}, fmt.Errorf("go env -json failed: %v", err)
+	}
+	var vars map[string]string
+	if err := json.Unmarshal(out, &vars); err != nil {
+		return Environ{}, fmt.Errorf("could not parse go env -json output: %v", err)
+	}
+	return environFromGoEnv(vars), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package golang
+
+import (
+	"go/build"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvironFromGoEnv(t *testing.T) {
+	c := environFromGoEnv(map[string]string{
+		"GOARCH":      "arm",
+		"GOARM":       "7",
+		"GOOS":        "linux",
+		"GOROOT":      "/usr/lib/go",
+		"GOPATH":      "/home/u/go",
+		"CGO_ENABLED": "0",
+		"GOPROXY":     "https://proxy.example.com",
+		"GONOSUMDB":   "example.com/private",
+		"GOVERSION":   "go1.22.3",
+	})
+	c.GOFLAGS = "-mod=mod"
+	c.Hermetic = true
+	c.HermeticPATH = "/usr/bin"
+	c.Extra = []string{"GODEBUG=x=1", "CC=clang"}
+
+	want := []string{
+		"GOARCH=arm",
+		"GOOS=linux",
+		"GOPATH=/home/u/go",
+		"CGO_ENABLED=0",
+		"GO111MODULE=",
+		"GOFLAGS=-mod=mod",
+		"GOARM=7",
+		"GOPROXY=https://proxy.example.com",
+		"GONOSUMDB=example.com/private",
+		"GOENV=off",
+		"CC=clang",
+		"GODEBUG=x=1",
+		"GOROOT=/usr/lib/go",
+		"PATH=/usr/lib/go/bin:/usr/bin",
+	}
+	if got := c.CmdEnv(); !reflect.DeepEqual(got, want) {
+		t.Errorf("CmdEnv() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestHermeticPATH(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  Environ
+		want string
+	}{
+		{
+			name: "default",
+			env:  Environ{Context: build.Context{GOROOT: "/usr/lib/go"}, Hermetic: true},
+			want: "PATH=/usr/lib/go/bin:" + DefaultHermeticPATH,
+		},
+		{
+			name: "no GOROOT",
+			env:  Environ{Hermetic: true, HermeticPATH: "/opt/bin"},
+			want: "PATH=/opt/bin",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env.Env()
+			if got := env[len(env)-1]; got != tt.want {
+				t.Errorf("Env() PATH = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCmdEnvInherits(t *testing.T) {
+	c := Default()
+	c.GOPROXY = "off"
+	env := c.CmdEnv()
+	if len(env) <= len(c.Env()) {
+		t.Errorf("CmdEnv() does not contain process environment")
+	}
+	if last := env[len(env)-1]; !strings.HasPrefix(last, "PATH=") || !strings.HasSuffix(last, os.Getenv("PATH")) {
+		t.Errorf("CmdEnv() PATH = %q, want to include process PATH", last)
+	}
+	var found bool
+	for _, v := range env {
+		found = found || v == "GOPROXY=off"
+	}
+	if !found {
+		t.Errorf("CmdEnv() does not contain GOPROXY override")
+	}
+}
+
+func TestLoadEnviron(t *testing.T) {
+	c, err := LoadEnviron(Default().GOROOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Valid(); err != nil {
+		t.Errorf("LoadEnviron() = %v", err)
+	}
+	if c.GOCACHE == "" {
+		t.Errorf("LoadEnviron() did not load GOCACHE")
+	}
+
+	c.Hermetic = true
+	if _, err := c.Version(); err != nil {
+		t.Errorf("hermetic go version failed: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monoimporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// GoListExports finds export data of packages compiled by `go list -export`.
+//
+// The export data files live in the Go build cache. Unlike $GOROOT/pkg, which
+// Go toolchains no longer ship, this works for standard library packages,
+// too. Reading them requires a golang.org/x/tools/go/gcexportdata that knows
+// the export data format of the Go toolchain that wrote them; the x/tools
+// version in go.mod must be at least as new as the toolchain.
+type GoListExports struct {
+	// Export maps import paths to export data files.
+	Export map[string]string
+
+	// ImportMap maps import paths as they appear in source files to the
+	// import paths of Export, e.g. golang.org/x/sys/unix to
+	// example.com/cmd/vendor/golang.org/x/sys/unix for vendored packages.
+	ImportMap map[string]string
+}
+
+// goListPackage is the part of `go list -json` output GoListExports uses.
+type goListPackage struct {
+	ImportPath string
+	Export     string
+	ImportMap  map[string]string
+}
+
+// ReadGoListExports reads the output of `go list -export -deps -json` from r.
+//
+// Packages without export data, e.g. because they failed to compile, are left
+// out.
+func ReadGoListExports(r io.Reader) (*GoListExports, error) {
+	g := &GoListExports{
+		Export:    make(map[string]string),
+		ImportMap: make(map[string]string),
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var p goListPackage
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse go list output: %v", err)
+		}
+		if p.Export != "" {
+			g.Export[p.ImportPath] = p.Export
+		}
+		for src, path := range p.ImportMap {
+			g.ImportMap[src] = path
+		}
+	}
+	return g, nil
+}
+
+// GoList runs `go list -export -deps -json` for patterns in dir with env, and
+// returns the export data of the packages matching patterns and all their
+// dependencies. If tests is true, the dependencies of their tests are
+// included.
+//
+// The go command compiles packages whose export data is not in the build
+// cache yet.
+func GoList(env golang.Environ, dir string, tests bool, patterns ...string) (*GoListExports, error) {
+	args := []string{"list", "-export", "-deps", "-json"}
+	if tests {
+		args = append(args, "-test")
+	}
+	if len(env.BuildTags) > 0 {
+		args = append(args, "-tags", strings.Join(env.BuildTags, ","))
+	}
+	if env.InstallSuffix != "" {
+		args = append(args, "-installsuffix", env.InstallSuffix)
+	}
+	cmd := env.GoCmd(append(args, patterns...)...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("go list -export failed: %v: %s", err, ee.Stderr)
+		}
+		return nil, fmt.Errorf("go list -export failed: %v", err)
+	}
+	return ReadGoListExports(bytes.NewReader(out))
+}
+
+// FindAndOpen implements Finder.
+func (g *GoListExports) FindAndOpen(pkg string) io.ReadCloser {
+	return openMapped(g.Export, g.ImportMap, pkg)
+}
+
+// NewFromGoList returns an importer that imports packages from the export
+// data found by `go list -export`. See GoList.
+func NewFromGoList(exports *GoListExports) *Importer {
+	return NewFromFinders(exports)
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monoimporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+func TestReadGoListExports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monoimporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	unix := filepath.Join(dir, "unix-d")
+	if err := ioutil.WriteFile(unix, []byte("unix export data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := `{
+	"ImportPath": "example.com/cmd/vendor/golang.org/x/sys/unix",
+	"Export": "` + unix + `"
+}
+{
+	"ImportPath": "example.com/cmd/broken"
+}
+{
+	"ImportPath": "example.com/cmd",
+	"Export": "` + filepath.Join(dir, "cmd-d") + `",
+	"ImportMap": {
+		"golang.org/x/sys/unix": "example.com/cmd/vendor/golang.org/x/sys/unix"
+	}
+}
+`
+	g, err := ReadGoListExports(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.Export["example.com/cmd/broken"]; ok {
+		t.Errorf("package without export data is in Export")
+	}
+
+	for _, pkg := range []string{"golang.org/x/sys/unix", "example.com/cmd/vendor/golang.org/x/sys/unix"} {
+		f := g.FindAndOpen(pkg)
+		if f == nil {
+			t.Errorf("FindAndOpen(%q) = nil, want export data", pkg)
+			continue
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "unix export data" {
+			t.Errorf("FindAndOpen(%q) = %q, want unix export data", pkg, b)
+		}
+	}
+	for _, pkg := range []string{"example.com/cmd", "example.com/other"} {
+		if f := g.FindAndOpen(pkg); f != nil {
+			f.Close()
+			t.Errorf("FindAndOpen(%q) = %v, want nil", pkg, f)
+		}
+	}
+
+	if _, err := ReadGoListExports(strings.NewReader("{")); err == nil {
+		t.Errorf("ReadGoListExports of invalid JSON = nil, want error")
+	}
+}
+
+func TestGoList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monoimporter-golist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"go.mod":     "module example.com/golist\n\ngo 1.13\n",
+		"lib/lib.go": "package lib\n\nimport \"fmt\"\n\nfunc Hello() fmt.Stringer { return nil }\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := GoList(golang.Default(), dir, false, "./...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Standard library export data comes from the build cache, too.
+	for _, pkg := range []string{"fmt", "io", "unicode/utf8", "example.com/golist/lib"} {
+		if _, err := os.Stat(g.Export[pkg]); err != nil {
+			t.Errorf("export data of %s: %v", pkg, err)
+		}
+	}
+
+	// The export data must be readable by the gcexportdata this module
+	// builds with, i.e. written by a toolchain it supports.
+	imp := NewFromGoList(g)
+	fmtPkg, err := imp.Import("fmt")
+	if err != nil {
+		t.Fatalf("Import(fmt) = %v", err)
+	}
+	if fmtPkg.Scope().Lookup("Stringer") == nil {
+		t.Errorf("fmt.Stringer not found in imported fmt")
+	}
+	lib, err := imp.Import("example.com/golist/lib")
+	if err != nil {
+		t.Fatalf("Import(example.com/golist/lib) = %v", err)
+	}
+	hello := lib.Scope().Lookup("Hello")
+	if hello == nil {
+		t.Fatalf("lib.Hello not found in imported lib")
+	}
+	if got, want := hello.Type().String(), "func() fmt.Stringer"; got != want {
+		t.Errorf("lib.Hello has type %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monoimporter
+
+import (
+	"go/importer"
+	"go/token"
+	"os"
+	"testing"
+)
+
+func TestLoadModeInstances(t *testing.T) {
+	dir, files := writeCmd(t, "package main\n\nfunc id[T any](v T) T { return v }\n\nfunc main() {\n\t_ = id(1)\n}\n")
+	defer os.RemoveAll(dir)
+
+	p, err := LoadMode("example.com/cmd", files, importer.ForCompiler(token.NewFileSet(), "source", nil), FullTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for id := range p.TypesInfo.Instances {
+		names = append(names, id.Name)
+	}
+	if len(names) != 1 || names[0] != "id" {
+		t.Errorf("LoadMode(FullTypes) instances = %v, want [id]", names)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monoimporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Manifest finds export data through a JSON file that maps import paths to
+// archive files, for build systems without a finder of their own, such as
+// Buck2, Please or Pants:
+//
+//	{
+//	  "archives": {
+//	    "fmt": "out/stdlib/linux_amd64/fmt.a",
+//	    "example.com/lib": "out/lib/lib.a",
+//	    "example.com/cmd/vendor/golang.org/x/sys/unix": "out/unix.a"
+//	  },
+//	  "importmap": {
+//	    "golang.org/x/sys/unix": "example.com/cmd/vendor/golang.org/x/sys/unix"
+//	  }
+//	}
+//
+// Relative archive paths are relative to the directory the tool runs in, like
+// the paths of the other archive finders, not to the manifest file.
+type Manifest struct {
+	// Archives maps import paths to archive or export data files.
+	Archives map[string]string `json:"archives"`
+
+	// ImportMap maps import paths as they appear in source files to the
+	// import paths of Archives, e.g. for vendored packages. It is
+	// optional.
+	ImportMap map[string]string `json:"importmap,omitempty"`
+}
+
+// ReadManifest reads a JSON manifest from path.
+func ReadManifest(path string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("could not parse archive manifest %s: %v", path, err)
+	}
+	if len(m.Archives) == 0 {
+		return nil, fmt.Errorf("archive manifest %s has no archives", path)
+	}
+	return &m, nil
+}
+
+// FindAndOpen implements Finder.
+func (m *Manifest) FindAndOpen(pkg string) io.ReadCloser {
+	return openMapped(m.Archives, m.ImportMap, pkg)
+}
+
+// openMapped opens the file files has for pkg, or for the import path
+// importMap maps pkg to.
+func openMapped(files, importMap map[string]string, pkg string) io.ReadCloser {
+	filename, ok := files[pkg]
+	if !ok {
+		if path, ok := importMap[pkg]; ok {
+			filename = files[path]
+		}
+	}
+	if filename == "" {
+		return nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	return f
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monoimporter
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeFinder map[string]string
+
+func (f fakeFinder) FindAndOpen(pkg string) io.ReadCloser {
+	if data, ok := f[pkg]; ok {
+		return ioutil.NopCloser(strings.NewReader(data))
+	}
+	return nil
+}
+
+func readAll(t *testing.T, rc io.ReadCloser) string {
+	t.Helper()
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monoimporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := filepath.Join(dir, "lib.a")
+	if err := ioutil.WriteFile(lib, []byte("lib export data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(manifest, []byte(`{
+  "archives": {
+    "example.com/vendor/example.org/lib": "`+lib+`",
+    "example.com/missing": "`+filepath.Join(dir, "missing.a")+`"
+  },
+  "importmap": {
+    "example.org/lib": "example.com/vendor/example.org/lib"
+  }
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range []string{"example.org/lib", "example.com/vendor/example.org/lib"} {
+		rc := m.FindAndOpen(pkg)
+		if rc == nil {
+			t.Errorf("FindAndOpen(%q) = nil, want lib export data", pkg)
+		} else if got := readAll(t, rc); got != "lib export data" {
+			t.Errorf("FindAndOpen(%q) = %q, want lib export data", pkg, got)
+		}
+	}
+	for _, pkg := range []string{"example.com/missing", "fmt"} {
+		if rc := m.FindAndOpen(pkg); rc != nil {
+			rc.Close()
+			t.Errorf("FindAndOpen(%q) = %v, want nil", pkg, rc)
+		}
+	}
+
+	for _, bad := range []string{"{", `{"archives": {}}`} {
+		if err := ioutil.WriteFile(manifest, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadManifest(manifest); err == nil {
+			t.Errorf("ReadManifest(%q) = nil, want error", bad)
+		}
+	}
+}
+
+func TestFindOrder(t *testing.T) {
+	finders := []Finder{
+		fakeFinder{"a": "first"},
+		fakeFinder{"a": "second", "b": "second"},
+	}
+	for pkg, want := range map[string]string{"a": "first", "b": "second"} {
+		rc := find(finders, pkg)
+		if rc == nil {
+			t.Errorf("find(%q) = nil, want %s", pkg, want)
+		} else if got := readAll(t, rc); got != want {
+			t.Errorf("find(%q) = %s, want %s", pkg, got, want)
+		}
+	}
+	if rc := find(finders, "c"); rc != nil {
+		t.Errorf("find(c) = %v, want nil", rc)
+	}
+}
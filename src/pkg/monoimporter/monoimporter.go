@@ -20,16 +20,20 @@ import (
 	"golang.org/x/tools/go/packages"
 )
 
-type finder interface {
-	findAndOpen(pkg string) io.ReadCloser
+// Finder finds export data of Go packages, e.g. compiled archives of a build
+// system.
+//
+// Finders for Bazel, Blaze and the go command are part of this package;
+// others can be built with a Manifest or by implementing Finder.
+type Finder interface {
+	// FindAndOpen returns the export data of the package with import path
+	// pkg, or nil if it cannot find it.
+	FindAndOpen(pkg string) io.ReadCloser
 }
 
-func find(finders []finder, pkg string) io.ReadCloser {
+func find(finders []Finder, pkg string) io.ReadCloser {
 	for _, f := range finders {
-		if f == nil {
-			continue
-		}
-		if file := f.findAndOpen(pkg); file != nil {
+		if file := f.FindAndOpen(pkg); file != nil {
 			return file
 		}
 	}
@@ -68,7 +72,7 @@ func goEnvDir(ctxt build.Context) string {
 	return fmt.Sprintf("%s_%s%s", ctxt.GOOS, ctxt.GOARCH, suffix)
 }
 
-func (z *zipReader) findAndOpen(pkg string) io.ReadCloser {
+func (z *zipReader) FindAndOpen(pkg string) io.ReadCloser {
 	pkg = strings.TrimPrefix(pkg, "google3/")
 	name := fmt.Sprintf("%s/%s.x", goEnvDir(z.ctxt), pkg)
 	f, ok := z.files[name]
@@ -102,7 +106,7 @@ type stdlibArchives struct {
 // bazel Starlark rules pass stdlib .a files one of two ways: either as a list
 // of individual files (e.g. linux_amd64/math/rand.a), or as just a directory
 // name.
-func (a stdlibArchives) findAndOpen(pkg string) io.ReadCloser {
+func (a stdlibArchives) FindAndOpen(pkg string) io.ReadCloser {
 	// bazel stdlib archives should be found using this method.
 	//
 	// bazel prefers .a files.
@@ -136,7 +140,7 @@ type unmappedArchives struct {
 	archs []string
 }
 
-func (a unmappedArchives) findAndOpen(pkg string) io.ReadCloser {
+func (a unmappedArchives) FindAndOpen(pkg string) io.ReadCloser {
 	pkg = strings.TrimPrefix(pkg, "google3/")
 
 	// in blaze, pkg path == file path, and we prefer .x
@@ -168,7 +172,7 @@ type mappedArchives struct {
 }
 
 // bazel Starlark rules pass a list of Go import path -> archive file path.
-func (a mappedArchives) findAndOpen(pkg string) io.ReadCloser {
+func (a mappedArchives) FindAndOpen(pkg string) io.ReadCloser {
 	// In bazel, non-stdlib dependencies should be found through this,
 	// because we pass an explicit map of import path -> archive path from
 	// the Starlark rules.
@@ -194,13 +198,8 @@ type Importer struct {
 	// imports is a cache of imported packages.
 	imports map[string]*types.Package
 
-	mapped   *mappedArchives
-	unmapped *unmappedArchives
-	stdlib   *stdlibArchives
-
-	// stdlibZip is an archive reader for standard library package object
-	// files.
-	stdlibZip *zipReader
+	// finders find export data, in order of precedence.
+	finders []Finder
 }
 
 // NewFromZips returns a new monorepo importer, using the build context to pick
@@ -210,6 +209,16 @@ type Importer struct {
 //
 // archives refers to directories in which to find compiled Go package object files.
 func NewFromZips(ctxt build.Context, unmappedArchs, mappedArchs, stdlibArchs, stdlibZips []string) (*Importer, error) {
+	finders, err := ArchiveFinders(ctxt, unmappedArchs, mappedArchs, stdlibArchs, stdlibZips)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromFinders(finders...), nil
+}
+
+// ArchiveFinders returns the finders of NewFromZips, e.g. to combine them with
+// other finders in NewFromFinders.
+func ArchiveFinders(ctxt build.Context, unmappedArchs, mappedArchs, stdlibArchs, stdlibZips []string) ([]Finder, error) {
 	// Some architectures have extra stuff after the GOARCH in the stdlib filename.
 	ctxtWithWildcard := ctxt
 	ctxtWithWildcard.GOARCH += "*"
@@ -246,24 +255,44 @@ func NewFromZips(ctxt build.Context, unmappedArchs, mappedArchs, stdlibArchs, st
 	}
 	ua := &unmappedArchives{archs: unmappedArchs}
 
-	return New(ctxt, ua, ma, sa, stdlib), nil
+	return archiveFinders(ctxt, ua, ma, sa, stdlib), nil
 }
 
 // New returns a new monorepo importer.
 func New(ctxt build.Context, ua *unmappedArchives, ma *mappedArchives, sa *stdlibArchives, stdlibZip *zip.Reader) *Importer {
-	i := &Importer{
+	return NewFromFinders(archiveFinders(ctxt, ua, ma, sa, stdlibZip)...)
+}
+
+// NewFromFinders returns an importer that imports packages from the export
+// data found by the first of finders that finds it.
+func NewFromFinders(finders ...Finder) *Importer {
+	return &Importer{
 		imports: map[string]*types.Package{
 			"unsafe": types.Unsafe,
 		},
-		fset:     token.NewFileSet(),
-		mapped:   ma,
-		stdlib:   sa,
-		unmapped: ua,
+		fset:    token.NewFileSet(),
+		finders: finders,
+	}
+}
+
+// archiveFinders returns the non-nil finders of Bazel and Blaze archives.
+func archiveFinders(ctxt build.Context, ua *unmappedArchives, ma *mappedArchives, sa *stdlibArchives, stdlibZip *zip.Reader) []Finder {
+	// A nil pointer in a Finder interface value is not nil, so they have
+	// to be left out here.
+	var finders []Finder
+	if ma != nil {
+		finders = append(finders, ma)
+	}
+	if ua != nil {
+		finders = append(finders, ua)
+	}
+	if sa != nil {
+		finders = append(finders, sa)
 	}
 	if stdlibZip != nil {
-		i.stdlibZip = newZipReader(stdlibZip, ctxt)
+		finders = append(finders, newZipReader(stdlibZip, ctxt))
 	}
-	return i
+	return finders
 }
 
 // Import implements types.Importer.Import.
@@ -272,13 +301,7 @@ func (i *Importer) Import(importPath string) (*types.Package, error) {
 		return pkg, nil
 	}
 
-	finders := []finder{
-		i.mapped,
-		i.unmapped,
-		i.stdlib,
-		i.stdlibZip,
-	}
-	file := find(finders, importPath)
+	file := find(i.finders, importPath)
 	if file == nil {
 		return nil, fmt.Errorf("package %q not found", importPath)
 	}
@@ -291,8 +314,28 @@ func (i *Importer) Import(importPath string) (*types.Package, error) {
 	return gcexportdata.Read(r, i.fset, i.imports, importPath)
 }
 
-// Load loads a google3 package.
+// Mode is how thoroughly LoadMode type-checks a package.
+type Mode int
+
+const (
+	// DeclsOnly type-checks package-level declarations, but not function
+	// bodies, and records only Types and Scopes. That is all the busybox
+	// rewrite needs.
+	DeclsOnly Mode = iota
+
+	// FullTypes type-checks function bodies, too, and records Types,
+	// Defs, Uses, Implicits, Selections, Scopes and Instances, like
+	// go/packages does.
+	FullTypes
+)
+
+// Load loads a google3 package, type-checking only its declarations.
 func Load(pkgPath string, filepaths []string, importer types.Importer) (*packages.Package, error) {
+	return LoadMode(pkgPath, filepaths, importer, DeclsOnly)
+}
+
+// LoadMode loads a google3 package, type-checking it as mode says.
+func LoadMode(pkgPath string, filepaths []string, importer types.Importer, mode Mode) (*packages.Package, error) {
 	p := &packages.Package{
 		PkgPath: pkgPath,
 	}
@@ -313,8 +356,9 @@ func Load(pkgPath string, filepaths []string, importer types.Importer) (*package
 	conf := types.Config{
 		Importer: importer,
 
-		// We only need global declarations' types.
-		IgnoreFuncBodies: true,
+		// Unless asked for more, we only need global declarations'
+		// types.
+		IgnoreFuncBodies: mode == DeclsOnly,
 	}
 
 	p.TypesInfo = &types.Info{
@@ -323,6 +367,13 @@ func Load(pkgPath string, filepaths []string, importer types.Importer) (*package
 		Types:  make(map[ast.Expr]types.TypeAndValue),
 		Scopes: make(map[ast.Node]*types.Scope),
 	}
+	if mode == FullTypes {
+		p.TypesInfo.Defs = make(map[*ast.Ident]types.Object)
+		p.TypesInfo.Uses = make(map[*ast.Ident]types.Object)
+		p.TypesInfo.Implicits = make(map[ast.Node]types.Object)
+		p.TypesInfo.Selections = make(map[*ast.SelectorExpr]*types.Selection)
+		p.TypesInfo.Instances = make(map[*ast.Ident]types.Instance)
+	}
 	// It's important that p.Syntax be in the same order every time for
 	// p.TypesInfo to be stable.
 	tpkg, err := conf.Check(pkgPath, p.Fset, p.Syntax, p.TypesInfo)
@@ -330,5 +381,6 @@ func Load(pkgPath string, filepaths []string, importer types.Importer) (*package
 		return nil, fmt.Errorf("type checking failed: %v", err)
 	}
 	p.Types = tpkg
+	p.Name = tpkg.Name()
 	return p, nil
 }
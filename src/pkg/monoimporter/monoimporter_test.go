@@ -0,0 +1,101 @@
+// Copyright 2021 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monoimporter
+
+import (
+	"go/importer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const cmdSource = `package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var prefix = "hello"
+
+func main() {
+	var b strings.Builder
+	b.WriteString(prefix)
+	fmt.Println(b.String())
+}
+`
+
+func writeCmd(t *testing.T, src string) (string, []string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "monoimporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "main.go")
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, []string{path}
+}
+
+func TestLoadMode(t *testing.T) {
+	dir, files := writeCmd(t, cmdSource)
+	defer os.RemoveAll(dir)
+	imp := importer.ForCompiler(token.NewFileSet(), "source", nil)
+
+	p, err := Load("example.com/cmd", files, imp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "main" || p.Types == nil {
+		t.Errorf("Load() = package %q with types %v, want main with types", p.Name, p.Types)
+	}
+	if p.TypesInfo.Uses != nil || p.TypesInfo.Selections != nil {
+		t.Errorf("Load() recorded Uses or Selections, want only Types and Scopes")
+	}
+
+	p, err = LoadMode("example.com/cmd", files, imp, FullTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uses := make(map[string]bool)
+	for id, obj := range p.TypesInfo.Uses {
+		if obj.Pkg() != nil {
+			uses[obj.Pkg().Path()+"."+id.Name] = true
+		}
+	}
+	for _, want := range []string{"fmt.Println", "strings.Builder", "example.com/cmd.prefix"} {
+		if !uses[want] {
+			t.Errorf("LoadMode(FullTypes) did not record use of %s in a function body", want)
+		}
+	}
+	var selections []string
+	for sel := range p.TypesInfo.Selections {
+		selections = append(selections, sel.Sel.Name)
+	}
+	if len(selections) != 2 {
+		t.Errorf("LoadMode(FullTypes) selections = %v, want WriteString and String", selections)
+	}
+	if len(p.TypesInfo.Defs) == 0 {
+		t.Errorf("LoadMode(FullTypes) recorded no Defs")
+	}
+}
+
+func TestLoadModeBodyErrors(t *testing.T) {
+	dir, files := writeCmd(t, "package main\n\nfunc main() {\n\tvar x int = \"not an int\"\n\t_ = x\n}\n")
+	defer os.RemoveAll(dir)
+	imp := importer.ForCompiler(token.NewFileSet(), "source", nil)
+
+	// Function bodies are only checked with FullTypes.
+	if _, err := Load("example.com/cmd", files, imp); err != nil {
+		t.Errorf("Load() = %v, want nil", err)
+	}
+	if _, err := LoadMode("example.com/cmd", files, imp, FullTypes); err == nil {
+		t.Errorf("LoadMode(FullTypes) = nil, want type error")
+	}
+}
@@ -1,14 +1,24 @@
 """This module contains a macro to test that a target is statically linked."""
 
-def static_test(name, target, **kwargs):
+def static_test(name, target, goarch = None, **kwargs):
+    """Tests that target is a statically linked binary.
+
+    Args:
+      name: test name.
+      target: binary to test.
+      goarch: if set, also tests that target is an ELF binary for goarch.
+      **kwargs: passed to sh_test.
+    """
+    args = ["$(location %s)" % target]
+    if goarch:
+        args.append(goarch)
     native.sh_test(
         name = name,
         timeout = "short",
         srcs = ["//src:static_test"],
-        args = [
-            "$(location %s)" % target,
-        ],
+        args = args,
         data = [
             target,
         ],
+        **kwargs
     )
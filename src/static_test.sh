@@ -2,14 +2,51 @@
 
 set -eux
 declare -r BINARY="${1}"
+declare -r GOARCH="${2:-}"
+
+die() {
+  echo "$@" >&2
+  exit 1
+}
 
 if [[ -z "${BINARY}" ]]; then
-  die "usage: $0 <binary>"
+  die "usage: $0 <binary> [goarch]"
 fi
 
 if [[ ! -x "${BINARY}" ]]; then
   die "file must be executable"
 fi
 
+if [[ -n "${GOARCH}" ]]; then
+  # e_machine of the ELF header.
+  case "${GOARCH}" in
+    386) WANT=3 ;;
+    amd64) WANT=62 ;;
+    arm) WANT=40 ;;
+    arm64) WANT=183 ;;
+    mips | mipsle | mips64 | mips64le) WANT=8 ;;
+    ppc64 | ppc64le) WANT=21 ;;
+    riscv64) WANT=243 ;;
+    s390x) WANT=22 ;;
+    *) die "unknown GOARCH ${GOARCH}" ;;
+  esac
+
+  if [[ "$(head -c 4 "${BINARY}" | tail -c 3)" != "ELF" ]]; then
+    die "${BINARY} is not an ELF binary"
+  fi
+  # e_machine is a 2-byte field at offset 18, in the byte order given by
+  # e_ident[EI_DATA] at offset 5 (1: little endian, 2: big endian).
+  ENDIAN=$(od -An -tu1 -j5 -N1 "${BINARY}" | tr -d ' ')
+  MACHINE=($(od -An -tu1 -j18 -N2 "${BINARY}"))
+  if [[ "${ENDIAN}" == 2 ]]; then
+    GOT=$((MACHINE[0] * 256 + MACHINE[1]))
+  else
+    GOT=$((MACHINE[1] * 256 + MACHINE[0]))
+  fi
+  if [[ "${GOT}" != "${WANT}" ]]; then
+    die "${BINARY} has ELF machine ${GOT}, want ${WANT} for ${GOARCH}"
+  fi
+fi
+
 # ldd exits with 1 if it's not a dynamic executable.
 ldd "${BINARY}" || exit 0
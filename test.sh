@@ -7,3 +7,6 @@ set -eux
 bazel build //src/...
 
 bazel build --platforms=@io_bazel_rules_go//go/toolchain:linux_arm64 //src:bb
+
+bazel test //src:all
+bazel test //src/bazeltest/...